@@ -12,17 +12,21 @@ var elasticCmd = &cobra.Command{
 	Short: "send log data to elasticsearch",
 	Long:  `Send log data to ElasticSearch`,
 	Run: func(cmd *cobra.Command, args []string) {
-		n_workers := ConfiguredRuntimeWorkers()
-		sinks := make([]worker.Worker, n_workers)
-		for i := 0; i < n_workers; i++ {
-			w := &worker.ElasticSearchWorker{}
-			w.WorkerNumber = i
-			sinks[i] = w
-		}
-		run.Run(sinks)
+		run.Run(elasticWorkers(ConfiguredRuntimeWorkers()))
 	},
 }
 
+func elasticWorkers(n_workers int) []worker.Worker {
+	sinks := make([]worker.Worker, n_workers)
+	pool := worker.NewEsHostPool(nil)
+	for i := 0; i < n_workers; i++ {
+		w := &worker.ElasticSearchWorker{HostPool: pool}
+		w.WorkerNumber = i
+		sinks[i] = w
+	}
+	return sinks
+}
+
 func init() {
 	RootCmd.AddCommand(elasticCmd)
 
@@ -12,15 +12,19 @@ var fileCmd = &cobra.Command{
 	Short: "send log data to a file",
 	Long:  `Send log data to another file in JSONL format`,
 	Run: func(cmd *cobra.Command, args []string) {
-		n_workers := 1 // ignore configuration!
-		sinks := make([]worker.Worker, n_workers)
-		for i := 0; i < n_workers; i++ {
-			sinks[i] = &worker.FileWorker{}
-		}
-		run.Run(sinks)
+		run.Run(fileWorkers())
 	},
 }
 
+func fileWorkers() []worker.Worker {
+	n_workers := 1 // ignore configuration!
+	sinks := make([]worker.Worker, n_workers)
+	for i := 0; i < n_workers; i++ {
+		sinks[i] = &worker.FileWorker{}
+	}
+	return sinks
+}
+
 func init() {
 	RootCmd.AddCommand(fileCmd)
 
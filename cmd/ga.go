@@ -1,22 +1,31 @@
 package cmd
 
 import (
-	"fmt"
-
 	"github.com/spf13/cobra"
+	"github.com/willf/translog/run"
+	"github.com/willf/translog/worker"
 )
 
 // gaCmd represents the ga command
 var gaCmd = &cobra.Command{
 	Use:   "ga",
-	Short: "send log data to Google Analytics (tbd)",
-	Long:  `Send log data to Google Analytics (tbd)`,
+	Short: "send log data to Google Analytics",
+	Long: `Send log data to Google Analytics, as page view or event hits
+of the Measurement Protocol`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Work your own magic here
-		fmt.Println("I lament to say that the GA module is not yet written")
+		run.Run(gaWorkers())
 	},
 }
 
+func gaWorkers() []worker.Worker {
+	n_workers := 1 // hits are sent in order
+	sinks := make([]worker.Worker, n_workers)
+	for i := 0; i < n_workers; i++ {
+		sinks[i] = &worker.GoogleAnalyticsWorker{}
+	}
+	return sinks
+}
+
 func init() {
 	RootCmd.AddCommand(gaCmd)
 
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/willf/translog/run"
+	"github.com/willf/translog/worker"
+)
+
+const configPipelineSinks = "pipeline.sinks"
+const configPipelineWorkers = "pipeline.workers"
+
+// ConfiguredPipelineSinks returns the names of the sinks every event is sent to
+func ConfiguredPipelineSinks() []string {
+	return viper.GetStringSlice(configPipelineSinks)
+}
+
+// ConfiguredSinkWorkers returns the number of workers for the named sink.
+// Only elastic may have more than one; it defaults to runtime.workers.
+func ConfiguredSinkWorkers(name string) int {
+	if name != "elastic" {
+		return 1
+	}
+	key := configPipelineWorkers + "." + name
+	if viper.IsSet(key) {
+		return viper.GetInt(key)
+	}
+	return ConfiguredRuntimeWorkers()
+}
+
+func newSink(name string) (sink run.Sink, err error) {
+	var workers []worker.Worker
+	switch name {
+	case "elastic":
+		workers = elasticWorkers(ConfiguredSinkWorkers(name))
+	case "file":
+		workers = fileWorkers()
+	case "stdout":
+		workers = stdoutWorkers()
+	case "ga":
+		workers = gaWorkers()
+	default:
+		err = fmt.Errorf("Unknown sink %s", name)
+	}
+	return run.Sink{Name: name, Workers: workers}, err
+}
+
+// pipelineCmd represents the pipeline command
+var pipelineCmd = &cobra.Command{
+	Use:   "pipeline",
+	Short: "send log data to several sinks at once",
+	Long: `Send every event to each of the sinks named in pipeline.sinks
+(elastic, file, stdout and ga), for example to ElasticSearch and
+a JSONL archive file at the same time`,
+	Run: func(cmd *cobra.Command, args []string) {
+		names := ConfiguredPipelineSinks()
+		if len(names) == 0 {
+			fmt.Fprintf(os.Stderr, "No sinks configured; set %s\n", configPipelineSinks)
+			os.Exit(-1)
+		}
+		sinks := make([]run.Sink, len(names))
+		for i, name := range names {
+			sink, err := newSink(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(-1)
+			}
+			sinks[i] = sink
+		}
+		run.RunSinks(sinks)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(pipelineCmd)
+}
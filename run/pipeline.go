@@ -0,0 +1,68 @@
+package run
+
+import (
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+const configPipelineBuffer = "pipeline.buffer"
+
+// DefaultSinkBuffer is the default number of events waiting for each sink
+const DefaultSinkBuffer = 1000
+
+// Sink is a pool of workers of one kind. Every sink receives every event,
+// and the workers of a sink share its events between them.
+type Sink struct {
+	Name    string
+	Workers []worker.Worker
+	work    chan map[string]interface{}
+}
+
+// ConfiguredSinkBuffer is the number of events which may wait for each
+// sink, so that a sink which falls behind does not hold up the others
+func ConfiguredSinkBuffer() int {
+	if viper.IsSet(configPipelineBuffer) {
+		return viper.GetInt(configPipelineBuffer)
+	}
+	return DefaultSinkBuffer
+}
+
+func (s *Sink) start() {
+	s.work = make(chan map[string]interface{}, ConfiguredSinkBuffer())
+	for _, w := range s.Workers {
+		w.SetWorkChannel(s.work)
+		w.Init()
+		go w.Start()
+	}
+}
+
+func (s *Sink) stop() {
+	for _, w := range s.Workers {
+		w.Stop()
+	}
+}
+
+// fanOut sends each event from in to every sink, until quit is closed.
+// An event is only acknowledged once all of the sinks have delivered it.
+func fanOut(in chan map[string]interface{}, sinks []Sink, quit chan bool) {
+	for {
+		var obj map[string]interface{}
+		var ok bool
+		select {
+		case obj, ok = <-in:
+			if !ok {
+				return
+			}
+		case <-quit:
+			return
+		}
+		worker.ShareEvent(obj, len(sinks))
+		for i := range sinks {
+			select {
+			case sinks[i].work <- obj:
+			case <-quit:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package run
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+// collector is a worker which collects the events sent to it
+type collector struct {
+	work   chan map[string]interface{}
+	lock   *sync.Mutex
+	events *[]map[string]interface{}
+	done   *sync.WaitGroup
+}
+
+func (c *collector) Init() error                                        { return nil }
+func (c *collector) Stop()                                              {}
+func (c *collector) SetWorkChannel(channel chan map[string]interface{}) { c.work = channel }
+func (c *collector) Start() {
+	for obj := range c.work {
+		c.lock.Lock()
+		*c.events = append(*c.events, obj)
+		c.lock.Unlock()
+		c.done.Done()
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	var lock sync.Mutex
+	var done sync.WaitGroup
+	var first, second []map[string]interface{}
+	sinks := []Sink{
+		{Name: "first", Workers: []worker.Worker{
+			&collector{lock: &lock, events: &first, done: &done},
+			&collector{lock: &lock, events: &first, done: &done},
+		}},
+		{Name: "second", Workers: []worker.Worker{&collector{lock: &lock, events: &second, done: &done}}},
+	}
+	for i := range sinks {
+		sinks[i].start()
+	}
+	in := make(chan map[string]interface{})
+	quit := make(chan bool)
+	go fanOut(in, sinks, quit)
+	done.Add(20)
+	for i := 0; i < 10; i++ {
+		in <- map[string]interface{}{"i": i}
+	}
+	done.Wait()
+	close(quit)
+	if len(first) != 10 || len(second) != 10 {
+		t.Errorf("expected every sink to get all 10 events, got %v and %v", len(first), len(second))
+	}
+}
+
+// stalled is a worker which never takes an event
+type stalled struct{}
+
+func (s *stalled) Init() error                                        { return nil }
+func (s *stalled) Start()                                             {}
+func (s *stalled) Stop()                                              {}
+func (s *stalled) SetWorkChannel(channel chan map[string]interface{}) {}
+
+func TestFanOutStalledSink(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("pipeline.buffer", 5)
+	var lock sync.Mutex
+	var done sync.WaitGroup
+	var events []map[string]interface{}
+	sinks := []Sink{
+		{Name: "stalled", Workers: []worker.Worker{&stalled{}}},
+		{Name: "collector", Workers: []worker.Worker{&collector{lock: &lock, events: &events, done: &done}}},
+	}
+	for i := range sinks {
+		sinks[i].start()
+	}
+	in := make(chan map[string]interface{})
+	quit := make(chan bool)
+	exited := make(chan bool)
+	go func() {
+		fanOut(in, sinks, quit)
+		close(exited)
+	}()
+	done.Add(5)
+	for i := 0; i < 5; i++ {
+		in <- map[string]interface{}{"i": i}
+	}
+	done.Wait()
+	// the stalled sink's buffer is full, so fanOut is now blocked on it
+	in <- map[string]interface{}{"i": 5}
+	close(quit)
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected fanOut to stop on quit while blocked on a sink")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/willf/translog/worker"
@@ -79,7 +80,13 @@ func createPidFile(pidFileName string) (pidFile *os.File, err error) {
 	return
 }
 
+// Run runs translog, with the workers of a single sink sharing the events
 func Run(sinks []worker.Worker) {
+	RunSinks([]Sink{{Name: "sink", Workers: sinks}})
+}
+
+// RunSinks runs translog, sending every event to each of the sinks
+func RunSinks(sinks []Sink) {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 	if viper.IsSet(configLogFile) {
 		logFile := viper.GetString(configLogFile)
@@ -104,19 +111,33 @@ func Run(sinks []worker.Worker) {
 	// set the number of Cpus
 	runtime.GOMAXPROCS(viper.GetInt(configRuntimeCpus))
 
+	worker.ConfigureDeadLetters()
+
 	// create the channels
 
-	work := make(chan map[string]interface{})
+	queue := worker.ConfiguredQueue()
+	work := queue.Channel()
 
 	logWorker := &worker.LogParser{}
 
-	logWorker.SetWorkChannel(work)
+	logWorker.SetQueue(queue)
 	logWorker.Init()
 
-	for _, sink := range sinks {
-		sink.SetWorkChannel(work)
-		sink.Init()
-		go sink.Start()
+	for i := range sinks {
+		logs.Info("Starting sink %s with %d workers", sinks[i].Name, len(sinks[i].Workers))
+		sinks[i].start()
+	}
+	spool := worker.ConfiguredSpool()
+	if spool != nil {
+		spool.Start(work)
+		work = spool.Channel()
+	}
+	stopFanOut := make(chan bool)
+	go fanOut(work, sinks, stopFanOut)
+
+	stopReports := make(chan bool)
+	if interval := worker.ConfiguredQueueReportInterval(); interval > 0 {
+		go queue.ReportEvery(time.Duration(interval)*time.Second, stopReports)
 	}
 
 	go logWorker.Start()
@@ -139,10 +160,18 @@ func Run(sinks []worker.Worker) {
 		}
 		logs.Info("Stopping Log Worker")
 		logWorker.Stop()
+		close(stopReports)
+		queue.Report()
+		close(stopFanOut)
 		logs.Info("Stopping sink workers")
 		for _, sink := range sinks {
-			sink.Stop()
+			sink.stop()
+		}
+		if spool != nil {
+			spool.Stop()
 		}
+		logWorker.SaveCheckpoint()
+		worker.CloseDeadLetters()
 		logs.Info("Exiting translog")
 		finished <- true
 	}()
@@ -0,0 +1,324 @@
+package worker
+
+/*
+	checkpoint.go records how far each input file has been delivered by the
+	sinks, so that translog can resume where it left off when restarted.
+
+	Positions are saved by path, along with the inode and device of the file,
+	so that a file which was rotated or truncated while translog was down is
+	not resumed at the wrong place. Positions of files which no longer exist
+	are dropped.
+*/
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configCheckpointFile = "checkpoint.file"
+const configCheckpointInterval = "checkpoint.interval"
+
+// DefaultCheckpointInterval is the default number of seconds between saves of the checkpoint file
+const DefaultCheckpointInterval = 5
+
+// FileID identifies a file independently of its path
+type FileID struct {
+	Inode  uint64 `json:"inode"`
+	Device uint64 `json:"device"`
+}
+
+// FilePosition is the delivered position within an input file
+type FilePosition struct {
+	Path string `json:"path"`
+	FileID
+	Offset int64 `json:"offset"`
+}
+
+// fileTracker follows the events read from one file. Events are numbered
+// as they are read, and the position only moves past an event once it and
+// all events before it have been delivered.
+type fileTracker struct {
+	position FilePosition
+	next     uint64
+	done     uint64
+	offsets  map[uint64]int64
+	acked    map[uint64]bool
+}
+
+// Checkpoint keeps the delivered positions of the input files
+type Checkpoint struct {
+	FileName string
+	lock     sync.Mutex
+	saved    map[string]FilePosition
+	trackers map[string]*fileTracker
+}
+
+// NewCheckpoint creates a checkpoint which is saved to fileName
+func NewCheckpoint(fileName string) *Checkpoint {
+	return &Checkpoint{
+		FileName: fileName,
+		saved:    map[string]FilePosition{},
+		trackers: map[string]*fileTracker{},
+	}
+}
+
+// ConfiguredCheckpoint loads the configured checkpoint file. It returns nil
+// if no checkpoint file is configured.
+func ConfiguredCheckpoint() *Checkpoint {
+	fileName := viper.GetString(configCheckpointFile)
+	if fileName == "" {
+		return nil
+	}
+	c := NewCheckpoint(fileName)
+	if err := c.Load(); err != nil {
+		logs.Warn("Unable to load checkpoint file %s: %v", fileName, err)
+	}
+	return c
+}
+
+// ConfiguredCheckpointInterval is how often the checkpoint is saved, in seconds
+func ConfiguredCheckpointInterval() int {
+	if viper.IsSet(configCheckpointInterval) {
+		return viper.GetInt(configCheckpointInterval)
+	}
+	return DefaultCheckpointInterval
+}
+
+// Load reads the saved positions. A missing file is not an error.
+func (c *Checkpoint) Load() error {
+	data, err := ioutil.ReadFile(c.FileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var positions []FilePosition
+	if err := json.Unmarshal(data, &positions); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, position := range positions {
+		c.saved[position.Path] = position
+	}
+	c.prune()
+	return nil
+}
+
+// prune drops the saved positions of files which no longer exist, and are
+// not being read. The lock must be held.
+func (c *Checkpoint) prune() {
+	for path := range c.saved {
+		if _, tracked := c.trackers[path]; tracked {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(c.saved, path)
+		}
+	}
+}
+
+// Save writes the current positions, replacing the checkpoint file atomically
+func (c *Checkpoint) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	c.prune()
+	positions := make([]FilePosition, 0, len(c.saved))
+	for path, position := range c.saved {
+		if tracker, found := c.trackers[path]; found {
+			position = tracker.position
+		}
+		positions = append(positions, position)
+	}
+	c.lock.Unlock()
+	data, err := json.MarshalIndent(positions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.FileName), filepath.Base(c.FileName))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.FileName)
+}
+
+// ResumeOffset decides where reading should start for the file at path, with
+// the given id and size. A saved position is looked up first by path and
+// then, if path is a rotated copy of a saved path (like a.log.1 or
+// a.log-20160401 of a.log), by id, so that a file renamed by rotation is
+// resumed too. If the file has shrunk below the saved offset it was
+// truncated, and is read from the start; so is a new file at a known path.
+// found is false if nothing is known about the file.
+func (c *Checkpoint) ResumeOffset(path string, id FileID, size int64) (offset int64, found bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	position, found := c.saved[path]
+	if (!found || position.FileID != id) && id != (FileID{}) {
+		for _, other := range c.saved {
+			if other.FileID == id && isRotatedCopy(path, other.Path) {
+				position, found = other, true
+				break
+			}
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	if position.FileID != id || size < position.Offset {
+		return 0, true
+	}
+	return position.Offset, true
+}
+
+// isRotatedCopy is whether path is named like a rotated copy of original
+func isRotatedCopy(path string, original string) bool {
+	return len(path) > len(original) && strings.HasPrefix(path, original)
+}
+
+// Open starts tracking the file at path from offset. Events tracked before
+// a file is opened again (say, after rotation) no longer move its position.
+func (c *Checkpoint) Open(path string, id FileID, offset int64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	position := FilePosition{Path: path, FileID: id, Offset: offset}
+	c.saved[path] = position
+	c.trackers[path] = &fileTracker{
+		position: position,
+		offsets:  map[uint64]int64{},
+		acked:    map[uint64]bool{},
+	}
+}
+
+// Track records an event ending at offset in the file at path. The returned
+// function must be called once the event has been delivered (or dropped).
+func (c *Checkpoint) Track(path string, offset int64) func() {
+	if c == nil {
+		return func() {}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tracker, found := c.trackers[path]
+	if !found {
+		return func() {}
+	}
+	seq := tracker.next
+	tracker.next++
+	tracker.offsets[seq] = offset
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			tracker.acked[seq] = true
+			for tracker.acked[tracker.done] {
+				tracker.position.Offset = tracker.offsets[tracker.done]
+				delete(tracker.acked, tracker.done)
+				delete(tracker.offsets, tracker.done)
+				tracker.done++
+			}
+		})
+	}
+}
+
+// Position returns the delivered position of the file at path
+func (c *Checkpoint) Position(path string) (position FilePosition, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tracker, ok := c.trackers[path]; ok {
+		return tracker.position, true
+	}
+	position, found = c.saved[path]
+	return
+}
+
+// LineLocator finds where each line sent by a tailer ends in the file it
+// was read from. It reads the file alongside the tailer: a line which is
+// not where the last one ended was read after the tailer opened the file
+// again, because it was rotated or truncated, so the file now at the path
+// is opened, and the line looked for at its start.
+type LineLocator struct {
+	Path   string
+	ID     FileID
+	Offset int64
+	file   *os.File
+}
+
+// NewLineLocator opens the file at path, whose lines are read from offset
+func NewLineLocator(path string, offset int64) *LineLocator {
+	l := &LineLocator{Path: path, Offset: offset}
+	l.open()
+	return l
+}
+
+// open opens the file now at the path
+func (l *LineLocator) open() bool {
+	l.Close()
+	file, err := os.Open(l.Path)
+	if err != nil {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return false
+	}
+	l.file, l.ID = file, fileID(info)
+	return true
+}
+
+// at is whether text, and a newline, are at offset in the file
+func (l *LineLocator) at(offset int64, text string) bool {
+	if l.file == nil {
+		return false
+	}
+	buf := make([]byte, len(text)+1)
+	n, _ := l.file.ReadAt(buf, offset)
+	return n == len(buf) && buf[len(text)] == '\n' && string(buf[:len(text)]) == text
+}
+
+// Locate returns the offset at which the next line, text, ends. reopened
+// is true if it is the first line of a file which has replaced the last one.
+func (l *LineLocator) Locate(text string) (offset int64, reopened bool) {
+	size := int64(len(text)) + 1
+	switch {
+	case l.at(l.Offset, text):
+		l.Offset += size
+	case l.open() && l.at(0, text):
+		l.Offset, reopened = size, true
+	default:
+		logs.Warn("Unable to find the line read from %s at offset %d; its offsets may be wrong", l.Path, l.Offset)
+		l.Offset += size
+	}
+	return l.Offset, reopened
+}
+
+// Close closes the file
+func (l *LineLocator) Close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
@@ -0,0 +1,153 @@
+package worker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/willf/translog/worker"
+)
+
+func TestCheckpointTrackInOrder(t *testing.T) {
+	c := worker.NewCheckpoint("")
+	id := worker.FileID{Inode: 1, Device: 2}
+	c.Open("/tmp/a.log", id, 10)
+	first := c.Track("/tmp/a.log", 20)
+	second := c.Track("/tmp/a.log", 30)
+	third := c.Track("/tmp/a.log", 40)
+	second()
+	if position, _ := c.Position("/tmp/a.log"); position.Offset != 10 {
+		t.Errorf("expected offset to wait for the first event at 10, but was %v", position.Offset)
+	}
+	first()
+	if position, _ := c.Position("/tmp/a.log"); position.Offset != 30 {
+		t.Errorf("expected offset 30, but was %v", position.Offset)
+	}
+	third()
+	third()
+	if position, _ := c.Position("/tmp/a.log"); position.Offset != 40 {
+		t.Errorf("expected offset 40, but was %v", position.Offset)
+	}
+}
+
+func TestCheckpointReopenIgnoresOldEvents(t *testing.T) {
+	c := worker.NewCheckpoint("")
+	c.Open("/tmp/a.log", worker.FileID{Inode: 1}, 0)
+	old := c.Track("/tmp/a.log", 500)
+	c.Open("/tmp/a.log", worker.FileID{Inode: 2}, 0)
+	old()
+	position, _ := c.Position("/tmp/a.log")
+	if position.Offset != 0 || position.Inode != 2 {
+		t.Errorf("expected new file at offset 0, but was %v", position)
+	}
+}
+
+var resumeTestCases = []struct {
+	path     string
+	id       worker.FileID
+	size     int64
+	expected int64
+	found    bool
+}{
+	{"a.log", worker.FileID{Inode: 1, Device: 9}, 200, 100, true},          // same file
+	{"a.log", worker.FileID{Inode: 1, Device: 9}, 50, 0, true},             // truncated
+	{"a.log", worker.FileID{Inode: 3, Device: 9}, 500, 0, true},            // replaced
+	{"a.log.1", worker.FileID{Inode: 1, Device: 9}, 200, 100, true},        // renamed
+	{"a.log-20160401", worker.FileID{Inode: 1, Device: 9}, 200, 100, true}, // renamed with a date
+	{"b.log", worker.FileID{Inode: 4, Device: 9}, 200, 0, false},           // unknown
+	{"b.log", worker.FileID{Inode: 1, Device: 9}, 200, 0, false},           // reused inode
+	{"a.log.1", worker.FileID{}, 200, 0, false},                            // no inode (Windows)
+}
+
+func TestCheckpointSaveAndResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "checkpoint.json")
+	logName := filepath.Join(dir, "a.log")
+	ioutil.WriteFile(logName, []byte("hello\n"), 0644)
+	c := worker.NewCheckpoint(fileName)
+	c.Open(logName, worker.FileID{Inode: 1, Device: 9}, 0)
+	c.Track(logName, 100)()
+	if err := c.Save(); err != nil {
+		t.Fatalf("unable to save checkpoint: %v", err)
+	}
+
+	loaded := worker.NewCheckpoint(fileName)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("unable to load checkpoint: %v", err)
+	}
+	for i, tt := range resumeTestCases {
+		offset, found := loaded.ResumeOffset(filepath.Join(dir, tt.path), tt.id, tt.size)
+		if offset != tt.expected || found != tt.found {
+			t.Errorf("In test %d, ResumeOffset(%v, %v, %v): expected %v, %v; actual %v, %v",
+				i+1, tt.path, tt.id, tt.size, tt.expected, tt.found, offset, found)
+		}
+	}
+}
+
+func TestCheckpointDropsRemovedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "checkpoint.json")
+	logName := filepath.Join(dir, "a.log")
+	ioutil.WriteFile(logName, []byte("hello\n"), 0644)
+	c := worker.NewCheckpoint(fileName)
+	c.Open(logName, worker.FileID{Inode: 1, Device: 9}, 0)
+	c.Track(logName, 6)()
+	c.Save()
+	os.Remove(logName)
+	loaded := worker.NewCheckpoint(fileName)
+	loaded.Load()
+	if _, found := loaded.Position(logName); found {
+		t.Errorf("expected the position of a removed file to be dropped")
+	}
+	if _, found := loaded.ResumeOffset(logName+".1", worker.FileID{Inode: 1, Device: 9}, 6); found {
+		t.Errorf("expected nothing to be resumed from a removed file")
+	}
+}
+
+func TestCheckpointMissingFile(t *testing.T) {
+	c := worker.NewCheckpoint("/nonexistent/checkpoint.json")
+	if err := c.Load(); err != nil {
+		t.Errorf("expected a missing checkpoint file to be fine, but got %v", err)
+	}
+}
+
+func TestLineLocatorRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.log")
+	ioutil.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644)
+	l := worker.NewLineLocator(path, 0)
+	defer l.Close()
+	if offset, reopened := l.Locate("one"); offset != 4 || reopened {
+		t.Errorf("expected the first line to end at 4, got %v (reopened %v)", offset, reopened)
+	}
+	// rotated before the rest of the old file is read
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("uno\n"), 0644)
+	for _, expected := range []struct {
+		line     string
+		offset   int64
+		reopened bool
+	}{{"two", 8, false}, {"three", 14, false}, {"uno", 4, true}} {
+		if offset, reopened := l.Locate(expected.line); offset != expected.offset || reopened != expected.reopened {
+			t.Errorf("expected %s to end at %v (reopened %v), got %v (%v)", expected.line, expected.offset, expected.reopened, offset, reopened)
+		}
+	}
+	// truncated in place
+	ioutil.WriteFile(path, []byte("eins\n"), 0644)
+	if offset, reopened := l.Locate("eins"); offset != 5 || !reopened {
+		t.Errorf("expected a truncated file to be read from the start, got %v (reopened %v)", offset, reopened)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import (
+	"os"
+	"syscall"
+)
+
+// StatFile returns the identity and size of the file at path
+func StatFile(path string) (id FileID, size int64, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	return fileID(info), info.Size(), nil
+}
+
+// fileID returns the inode and device of a file
+func fileID(info os.FileInfo) (id FileID) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		id = FileID{Inode: uint64(st.Ino), Device: uint64(st.Dev)}
+	}
+	return
+}
@@ -0,0 +1,21 @@
+package worker
+
+import (
+	"os"
+)
+
+// StatFile returns the size of the file at path. Files have no inode on
+// Windows, so rotation is only noticed when the file shrinks.
+func StatFile(path string) (id FileID, size int64, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	size = info.Size()
+	return
+}
+
+// fileID is the zero FileID: files have no inode on Windows
+func fileID(info os.FileInfo) FileID {
+	return FileID{}
+}
@@ -0,0 +1,167 @@
+package worker
+
+/*
+	dead_letter.go keeps the lines which could not be delivered: lines which
+	did not parse, and events which could not be marshalled or were rejected
+	by a sink. Each is counted by reason, and, if configured, written as a
+	JSON record with the raw line, its source file and offset, and the reason
+	to a dead-letter file, or sent on to a separate sink.
+*/
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configDeadLetterFile = "dead_letter.file"
+const configDeadLetterSink = "dead_letter.sink"
+
+// Reasons for which lines are dead-lettered
+const (
+	ReasonUnmatched     = "unmatched"      // the line did not parse
+	ReasonMarshalFailed = "marshal_failed" // the event could not be marshalled to JSON
+)
+
+// DeadLetterRecord describes a line which could not be delivered
+type DeadLetterRecord struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source,omitempty"`
+	Offset int64     `json:"offset,omitempty"`
+	Raw    string    `json:"raw"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// DeadLetter counts undeliverable lines and sends them to its destination
+type DeadLetter struct {
+	lock   sync.Mutex
+	counts map[string]int64
+	out    *os.File
+	sink   Worker
+	work   chan map[string]interface{}
+	closed chan bool
+}
+
+var deadLetters = &DeadLetter{counts: map[string]int64{}}
+
+// ConfigureDeadLetters opens the configured dead-letter destination:
+// the file dead_letter.file, or the sink dead_letter.sink (only "stdout"
+// is available). Without either, lines are only counted.
+func ConfigureDeadLetters() {
+	d := &DeadLetter{counts: map[string]int64{}}
+	if fileName := viper.GetString(configDeadLetterFile); fileName != "" {
+		out, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			logs.Warn("Unable to open dead-letter file %s because of %s", fileName, err)
+		} else {
+			d.out = out
+		}
+	}
+	switch sink := viper.GetString(configDeadLetterSink); sink {
+	case "":
+	case "stdout":
+		d.work = make(chan map[string]interface{})
+		d.closed = make(chan bool)
+		d.sink = &StdOutWorker{}
+		d.sink.SetWorkChannel(d.work)
+		d.sink.Init()
+		d.sink.Start()
+	default:
+		logs.Warn("Unknown dead-letter sink %s", sink)
+	}
+	deadLetters = d
+}
+
+// CloseDeadLetters logs the dead-letter counts, and closes the destination
+func CloseDeadLetters() {
+	d := deadLetters
+	counts, _ := json.Marshal(d.Counts())
+	logs.Info("Dead letters: %s", string(counts))
+	d.lock.Lock()
+	if d.out != nil {
+		d.out.Close()
+		d.out = nil
+	}
+	sink := d.sink
+	if sink != nil {
+		// records added from now on are only counted, and any on their
+		// way to the sink are given up
+		close(d.closed)
+		d.sink = nil
+		d.work = nil
+	}
+	d.lock.Unlock()
+	if sink != nil {
+		sink.Stop()
+	}
+}
+
+// DeadLetterCounts returns the number of lines dead-lettered, by reason
+func DeadLetterCounts() map[string]int64 {
+	return deadLetters.Counts()
+}
+
+// DeadLetterLine dead-letters a raw line read from source, ending at offset
+func DeadLetterLine(source string, offset int64, raw string, reason string, err error) {
+	record := DeadLetterRecord{Time: time.Now(), Source: source, Offset: offset, Raw: raw, Reason: reason}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	deadLetters.Add(record)
+}
+
+// DeadLetterEvent dead-letters the line an event was parsed from
+func DeadLetterEvent(obj map[string]interface{}, reason string, err error) {
+	meta := Metadata(obj)
+	if meta == nil {
+		DeadLetterLine("", 0, fmt.Sprint(obj), reason, err)
+	} else {
+		DeadLetterLine(meta.Source, meta.Offset, meta.Raw, reason, err)
+	}
+}
+
+// Counts returns the number of lines dead-lettered, by reason
+func (d *DeadLetter) Counts() map[string]int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	counts := make(map[string]int64, len(d.counts))
+	for reason, count := range d.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// Add counts a record, and sends it to the destination
+func (d *DeadLetter) Add(record DeadLetterRecord) {
+	logs.Debug("Dead letter (%s): %s", record.Reason, record.Raw)
+	d.lock.Lock()
+	d.counts[record.Reason]++
+	if d.out != nil {
+		line, err := json.Marshal(record)
+		if err == nil {
+			d.out.Write(append(line, '\n'))
+		}
+	}
+	work, closed := d.work, d.closed
+	d.lock.Unlock()
+	if work == nil {
+		return
+	}
+	// the sink may be slow, so the lock is not held while sending to it
+	select {
+	case <-closed:
+	case work <- map[string]interface{}{
+		"time":   record.Time,
+		"source": record.Source,
+		"offset": record.Offset,
+		"raw":    record.Raw,
+		"reason": record.Reason,
+		"error":  record.Error,
+	}:
+	}
+}
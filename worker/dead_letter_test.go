@@ -0,0 +1,81 @@
+package worker_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+func TestDeadLetterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "dead.jsonl")
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("dead_letter.file", fileName)
+	worker.ConfigureDeadLetters()
+	worker.DeadLetterLine("/var/log/a.log", 42, "garbage", worker.ReasonUnmatched, fmt.Errorf("no match"))
+	worker.DeadLetterLine("/var/log/a.log", 50, "more garbage", worker.ReasonUnmatched, nil)
+	worker.DeadLetterEvent(map[string]interface{}{"bad": make(chan int)}, worker.ReasonMarshalFailed, nil)
+	counts := worker.DeadLetterCounts()
+	if counts[worker.ReasonUnmatched] != 2 || counts[worker.ReasonMarshalFailed] != 1 {
+		t.Errorf("unexpected dead-letter counts %v", counts)
+	}
+	worker.CloseDeadLetters()
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []worker.DeadLetterRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record worker.DeadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("bad dead-letter record %s: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 dead-letter records, got %v", records)
+	}
+	first := records[0]
+	if first.Source != "/var/log/a.log" || first.Offset != 42 || first.Raw != "garbage" ||
+		first.Reason != worker.ReasonUnmatched || first.Error != "no match" {
+		t.Errorf("unexpected dead-letter record %v", first)
+	}
+}
+
+func TestDeadLetterAfterClose(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("dead_letter.sink", "stdout")
+	worker.ConfigureDeadLetters()
+	worker.CloseDeadLetters()
+	done := make(chan bool)
+	go func() {
+		worker.DeadLetterLine("/var/log/a.log", 42, "late", worker.ReasonUnmatched, nil)
+		worker.DeadLetterLine("/var/log/a.log", 50, "later", worker.ReasonUnmatched, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected lines dead-lettered after closing not to block")
+	}
+	if counts := worker.DeadLetterCounts(); counts[worker.ReasonUnmatched] != 2 {
+		t.Errorf("expected the late lines to be counted, got %v", counts)
+	}
+}
@@ -2,15 +2,16 @@ package worker
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fizx/logs"
@@ -19,27 +20,64 @@ import (
 
 // ElasticSearchWorker bulk uploads to ElasticSearch
 type ElasticSearchWorker struct {
-	WorkChannel  chan map[string]interface{}
-	QuitChannel  chan bool
-	WorkerNumber int
-	robinIndex   int
-	robinLock    sync.Mutex
-	counter      int
-	totalCounter int64
-	items        []string
-	startTime    time.Time
-	lastTime     time.Time
-	lastCount    int64
-	max          int
-	randInter    *rand.Rand
-	hosts        []string
-	port         int
-	scheme       string
-	index        string
-	documentType string
-	reportEvery  int64
-	mocking      bool
-	useSuffix    bool
+	WorkChannel       chan map[string]interface{}
+	QuitChannel       chan bool
+	WorkerNumber      int
+	HostPool          *EsHostPool // shared by the workers of a sink; created by Init if nil
+	robinIndex        int
+	robinLock         sync.Mutex
+	counter           int
+	totalCounter      int64
+	items             []string
+	events            []map[string]interface{}
+	startTime         time.Time
+	lastTime          time.Time
+	lastCount         int64
+	max               int
+	randInter         *rand.Rand
+	hosts             []string
+	port              int
+	scheme            string
+	index             string
+	documentType      string
+	reportEvery       int64
+	mocking           bool
+	useSuffix         bool
+	client            *http.Client
+	retries           int
+	durable           bool
+	stopping          chan bool
+	backoff           time.Duration
+	backoffMax        time.Duration
+	inFlight          chan bool
+	pending           sync.WaitGroup
+	sharing           bool
+	succeeded         int64
+	failed            int64
+	lastCreated       atomic.Value
+	flushInterval     time.Duration
+	flushTimer        <-chan time.Time
+	maxBytes          int
+	version           string
+	versionLock       sync.Mutex
+	action            string
+	dataStream        bool
+	idField           string
+	idHashFields      []string
+	indexTemplate     *IndexTemplate
+	auth              EsAuth
+	compression       string
+	bytesSent         int64
+	bytesUncompressed int64
+	bootstrapConfig   *EsBootstrap
+	bulkPath          string
+	defaultPipeline   string
+	pipelineTemplate  *IndexTemplate
+	routingField      string
+	selection         string
+	sniffing          bool
+	bytes             int
+	itemCount         int64
 }
 
 const (
@@ -52,6 +90,25 @@ const (
 	key_es_report_every    = "es.report_every"
 	key_es_mocking         = "es.mocking"
 	key_es_use_date_suffix = "es.use_date_suffix"
+	key_es_retries         = "es.retries"
+	key_es_retry_backoff   = "es.retry_backoff"
+	key_es_retry_max       = "es.retry_backoff_max"
+	key_es_max_in_flight   = "es.max_in_flight"
+	key_es_health_check    = "es.health_check_interval"
+	key_es_timeout         = "es.timeout"
+	key_es_flush_interval  = "es.flush_interval"
+	key_es_max_bytes       = "es.max_bytes"
+	key_es_compression     = "es.compression"
+)
+
+// CompressionGzip is the es.compression to gzip bulk request bodies
+const CompressionGzip = "gzip"
+
+// Reasons for which the Elasticsearch worker dead-letters events
+const (
+	ReasonRejected         = "rejected"          // Elasticsearch refused the bulk request
+	ReasonRetriesExhausted = "retries_exhausted" // the bulk request failed too many times
+	ReasonBulkItemFailed   = "bulk_item_failed"  // Elasticsearch rejected the document
 )
 
 func EsSetDefaults() {
@@ -67,6 +124,14 @@ func EsSetDefaults() {
 	viper.SetDefault(key_es_report_every, 10000)
 	viper.SetDefault(key_es_mocking, false)
 	viper.SetDefault(key_es_use_date_suffix, false)
+	viper.SetDefault(key_es_retries, 3)
+	viper.SetDefault(key_es_retry_backoff, 100)
+	viper.SetDefault(key_es_retry_max, 30000)
+	viper.SetDefault(key_es_max_in_flight, 2)
+	viper.SetDefault(key_es_health_check, 10)
+	viper.SetDefault(key_es_timeout, 60)
+	viper.SetDefault(key_es_flush_interval, 5)
+	viper.SetDefault(key_es_max_bytes, 10*1024*1024)
 }
 
 func ConfiguredElasticSearchHosts() []string {
@@ -105,11 +170,81 @@ func ConfiguredElasticSearchUseDateSuffix() bool {
 	return viper.GetBool(key_es_use_date_suffix)
 }
 
+// ConfiguredElasticSearchRetries is how many times a failed bulk request is
+// retried; negative retries it forever
+func ConfiguredElasticSearchRetries() int {
+	return viper.GetInt(key_es_retries)
+}
+
+// ConfiguredDurableInput is whether events which are not delivered will be
+// read again on restart, from the spool or the checkpointed input files.
+// Bulk requests which fail for want of a cluster are then retried until
+// they are delivered, instead of being dead-lettered.
+func ConfiguredDurableInput() bool {
+	return viper.GetString(configSpoolDir) != "" || viper.GetString(configCheckpointFile) != ""
+}
+
+// ConfiguredElasticSearchRetryBackoff is the wait before the first retry
+func ConfiguredElasticSearchRetryBackoff() time.Duration {
+	return time.Duration(viper.GetInt(key_es_retry_backoff)) * time.Millisecond
+}
+
+// ConfiguredElasticSearchRetryBackoffMax is the longest wait between retries
+func ConfiguredElasticSearchRetryBackoffMax() time.Duration {
+	return time.Duration(viper.GetInt(key_es_retry_max)) * time.Millisecond
+}
+
+// ConfiguredElasticSearchMaxInFlight is how many bulk requests a worker may
+// have outstanding at once
+func ConfiguredElasticSearchMaxInFlight() int {
+	if n := viper.GetInt(key_es_max_in_flight); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// ConfiguredElasticSearchHealthCheckInterval is how often dead hosts are checked
+func ConfiguredElasticSearchHealthCheckInterval() time.Duration {
+	return time.Duration(viper.GetInt(key_es_health_check)) * time.Second
+}
+
+// ConfiguredElasticSearchTimeout is how long a request may take
+func ConfiguredElasticSearchTimeout() time.Duration {
+	return time.Duration(viper.GetInt(key_es_timeout)) * time.Second
+}
+
+// ConfiguredElasticSearchFlushInterval is the longest a partial batch waits
+// before it is sent; zero waits for a full batch
+func ConfiguredElasticSearchFlushInterval() time.Duration {
+	return time.Duration(viper.GetFloat64(key_es_flush_interval) * float64(time.Second))
+}
+
+// ConfiguredElasticSearchMaxBytes is the largest a bulk request body may grow
+// before it is sent; zero has no limit
+func ConfiguredElasticSearchMaxBytes() int {
+	return viper.GetInt(key_es_max_bytes)
+}
+
+// ConfiguredElasticSearchCompression is how bulk request bodies are
+// compressed: "gzip", or "" for not at all
+func ConfiguredElasticSearchCompression() string {
+	compression := viper.GetString(key_es_compression)
+	switch compression {
+	case "", "none":
+		return ""
+	case CompressionGzip:
+		return compression
+	}
+	logs.Warn("Unknown Elasticsearch compression %s; not compressing", compression)
+	return ""
+}
+
 func (w *ElasticSearchWorker) Init() (err error) {
 	w.QuitChannel = make(chan bool)
 
 	w.counter = 0
-	w.robinIndex = 0
+	w.robinIndex = w.WorkerNumber
+	w.randInter = rand.New(rand.NewSource(time.Now().UnixNano() + int64(w.WorkerNumber)))
 	EsSetDefaults()
 	w.max = ConfiguredElasticSearchMax()
 	w.hosts = ConfiguredElasticSearchHosts()
@@ -120,29 +255,99 @@ func (w *ElasticSearchWorker) Init() (err error) {
 	w.reportEvery = ConfiguredElasticSearchReportEvery()
 	w.mocking = ConfiguredElasticSearchMocking()
 	w.useSuffix = ConfiguredElasticSearchUseDateSuffix()
+	if w.HostPool == nil {
+		w.HostPool = NewEsHostPool(nil)
+	}
+	w.HostPool.seed(w.hosts)
+	w.selection = ConfiguredElasticSearchHostSelection()
+	w.sniffing = ConfiguredElasticSearchSniff()
+	w.client = &http.Client{Timeout: ConfiguredElasticSearchTimeout()}
+	if w.auth, err = ConfiguredElasticSearchAuth(); err != nil {
+		logs.Fatal("Unable to read Elasticsearch credentials: %v", err)
+		return
+	}
+	tlsConfig, err := ConfiguredElasticSearchTLS()
+	if err != nil {
+		logs.Fatal("Unable to set up TLS for Elasticsearch: %v", err)
+		return
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		w.client.Transport = transport
+	}
+	w.retries = ConfiguredElasticSearchRetries()
+	w.durable = ConfiguredDurableInput()
+	w.stopping = make(chan bool)
+	w.backoff = ConfiguredElasticSearchRetryBackoff()
+	w.backoffMax = ConfiguredElasticSearchRetryBackoffMax()
+	w.inFlight = make(chan bool, ConfiguredElasticSearchMaxInFlight())
+	w.flushInterval = ConfiguredElasticSearchFlushInterval()
+	w.maxBytes = ConfiguredElasticSearchMaxBytes()
+	w.compression = ConfiguredElasticSearchCompression()
+	w.version = ConfiguredElasticSearchVersion()
+	w.action = ConfiguredElasticSearchAction()
+	w.dataStream = ConfiguredElasticSearchDataStream()
+	if w.dataStream && w.action != ActionCreate {
+		logs.Warn("Data streams only take %s actions, not %s", ActionCreate, w.action)
+		w.action = ActionCreate
+	}
+	template := w.index
+	if w.useSuffix {
+		template += "{:2006.01.02}"
+	}
+	w.indexTemplate = NewIndexTemplate(template, ConfiguredElasticSearchTimestampField(), ConfiguredElasticSearchTimezone(), ConfiguredElasticSearchIndexFallback())
+	w.defaultPipeline = ConfiguredElasticSearchPipeline()
+	w.bulkPath = BulkPath(w.defaultPipeline, ConfiguredElasticSearchRefresh())
+	if template := ConfiguredElasticSearchPipelineTemplate(); template != "" {
+		w.pipelineTemplate = NewIndexTemplate(template, ConfiguredElasticSearchTimestampField(), ConfiguredElasticSearchTimezone(), "")
+		w.pipelineTemplate.KeepCase = true
+	}
+	w.routingField = ConfiguredElasticSearchRoutingField()
+	if w.bootstrapConfig, err = ConfiguredElasticSearchBootstrap(w.index); err != nil {
+		logs.Warn("Unable to read the Elasticsearch bootstrap configuration; not bootstrapping: %v", err)
+		err = nil
+	}
+	w.idField = ConfiguredElasticSearchIDField()
+	w.idHashFields = ConfiguredElasticSearchIDHashFields()
+	if w.action == ActionUpdate && w.idField == "" && len(w.idHashFields) == 0 {
+		logs.Warn("Elasticsearch updates need an _id; set es.id_field or es.id_hash_fields")
+	}
 	_, err = url.Parse(w.Endpoint())
 	if err != nil {
 		logs.Fatal("Invalid Elastic Search endpoint: %v", w.Endpoint())
 		err = fmt.Errorf("Invalid Elastic Search endpoint: %v", w.Endpoint())
 		return
 	}
-	w.items = make([]string, w.max*2) // need to make room for create commands
+	w.reset()
 	return
 }
 
-func (w *ElasticSearchWorker) NextHost() string {
-	hosts := w.hosts
-	if len(hosts) == 0 {
-		return "localhost"
-	}
-	i := rand.Int31n(int32(len(hosts)))
-	return w.hosts[i]
+// reset clears out the batch
+func (w *ElasticSearchWorker) reset() {
+	w.counter = 0
+	w.bytes = 0
+	w.flushTimer = nil
+	w.items = make([]string, w.max*2) // need to make room for create commands
+	w.events = make([]map[string]interface{}, 0, w.max)
 }
 
 func (w *ElasticSearchWorker) Endpoint() string {
-	host := w.NextHost()
-	endpoint := fmt.Sprintf("%s://%s:%d/_bulk", w.scheme, host, w.port)
-	return endpoint
+	return w.hostURL(w.NextHost(), w.bulkPath)
+}
+
+// hostURL is the URL of path on host. A host may give its own port.
+func (w *ElasticSearchWorker) hostURL(host string, path string) string {
+	if strings.Contains(host, ":") {
+		return fmt.Sprintf("%s://%s%s", w.scheme, host, path)
+	}
+	return fmt.Sprintf("%s://%s:%d%s", w.scheme, host, w.port, path)
+}
+
+// healthy checks whether a host answers on its root endpoint
+func (w *ElasticSearchWorker) healthy(host string) bool {
+	status, _, err := w.request("GET", host, "/", nil)
+	return err == nil && status >= 200 && status <= 299
 }
 
 func (w *ElasticSearchWorker) CurrentCount() int {
@@ -173,12 +378,37 @@ func (w *ElasticSearchWorker) UseDateSuffix() bool {
 	return w.useSuffix
 }
 
+// BytesUncompressed is the size of the bulk request bodies, before compression
+func (w *ElasticSearchWorker) BytesUncompressed() int64 {
+	return atomic.LoadInt64(&w.bytesUncompressed)
+}
+
+// BytesSent is the size of the bulk request bodies as sent
+func (w *ElasticSearchWorker) BytesSent() int64 {
+	return atomic.LoadInt64(&w.bytesSent)
+}
+
 func (w *ElasticSearchWorker) SetWorkChannel(channel chan map[string]interface{}) {
 	w.WorkChannel = channel
 }
 
 // Start the work
 func (w *ElasticSearchWorker) Start() {
+	if !w.sharing {
+		w.sharing = true
+		// the first worker of a sink checks and sniffs the hosts for all of them
+		if stopChecks := w.HostPool.share(); stopChecks != nil {
+			if interval := ConfiguredElasticSearchHealthCheckInterval(); interval > 0 {
+				go w.HostPool.HealthCheckEvery(interval, w.healthy, stopChecks)
+			}
+			if w.sniffing && !w.Mocking() {
+				w.Sniff()
+				if interval := ConfiguredElasticSearchSniffInterval(); interval > 0 {
+					go w.sniffEvery(interval, stopChecks)
+				}
+			}
+		}
+	}
 	go w.Work()
 }
 
@@ -194,22 +424,36 @@ func (w *ElasticSearchWorker) Work() {
 			if w.counter >= w.max*2 || w.Mocking() {
 				w.flush(false)
 			}
-			line, err := json.Marshal(obj)
+			index := w.indexTemplate.Render(obj)
+			if _, found := w.dataStreamTimestamp(obj); w.dataStream && !found {
+				DeadLetterEvent(obj, ReasonMissingTimestamp, fmt.Errorf("no %s or %s for data stream %s", DataStreamTimestamp, w.indexTemplate.TimestampField, index))
+				Ack(obj)
+				break
+			}
+			createDoc, line, err := w.bulkLines(obj, index)
 			if err != nil {
 				logs.Info("Unable to marshal object %v", obj)
+				DeadLetterEvent(obj, ReasonMarshalFailed, err)
+				Ack(obj)
 				break
 			}
-			docType := w.DocumentType()
-			index := w.Index()
-			if w.UseDateSuffix() {
-				index += time.Now().Format("2006.01.02")
+			size := len(createDoc) + len(line) + 2
+			if w.maxBytes > 0 && w.counter > 0 && w.bytes+size > w.maxBytes {
+				w.flush(false)
+			}
+			if w.counter == 0 && w.flushInterval > 0 {
+				w.flushTimer = time.After(w.flushInterval)
 			}
-			createDoc := fmt.Sprintf(`{"create": { "_index": "%s", "_type": "%s"}}`,
-				index, docType)
+			w.bytes += size
 			w.items[w.counter] = createDoc
-			w.items[w.counter+1] = string(line)
+			w.items[w.counter+1] = line
+			w.events = append(w.events, obj)
 			w.counter += 2
 
+		case <-w.flushTimer:
+			logs.Debug("Worker #%v: flushing %v documents after %v", w.WorkerNumber, w.counter/2, w.flushInterval)
+			w.flush(false)
+
 		case <-w.QuitChannel:
 			logs.Info("Elasticsearch worker #%v received quit", w.WorkerNumber)
 			return
@@ -217,76 +461,40 @@ func (w *ElasticSearchWorker) Work() {
 	}
 }
 
-// Stop stops the w by send a message on its quit channel
+// Stop stops the w by send a message on its quit channel, and waits for
+// the outstanding bulk requests. Those retrying are stopped first, as Work
+// may be waiting for one of them to finish.
 func (w *ElasticSearchWorker) Stop() {
+	close(w.stopping)
 	w.QuitChannel <- true
 	w.flush(true)
-}
-
-//"took": 68,
-//  "errors": false,
-//  "items": [
-//    {
-//      "create": {
-//        "_index": "es-prod-analytics-2016.04.01",
-//        "_type": "event",
-//        "_id": "AVPTILBJZqnc5MImoVd8",
-//        "_version": 1,
-//        "status": 201
-//      }
-//    },
-
-func itemsCreated(body []byte) []string {
-	var idre = regexp.MustCompile(`\"_id\":\"(?P<id>[^\"]*)\"`)
-	matches := idre.FindAllStringSubmatch(string(body), -1)
-	var ids []string
-	ids = make([]string, len(matches))
-	for i, id := range matches {
-		ids[i] = id[1]
+	w.pending.Wait()
+	if w.sharing {
+		w.sharing = false
+		w.HostPool.unshare()
 	}
-	return ids
 }
 
 func (w *ElasticSearchWorker) flush(forceReport bool) {
 	reportEvery := w.ReportEvery()
 	w.totalCounter++
 	if w.counter > 0 {
-		var body []byte
+		events := w.events
 		if !w.Mocking() {
-			str := strings.Join(w.items[0:w.counter], "\n") + "\n"
-			go func() {
-				bs := []byte(str)
-				req, err := http.NewRequest("POST", w.Endpoint(), bytes.NewBuffer(bs))
-				if err != nil {
-					// should not happend...
-					logs.Warn("Creating request resulted in an error: %v", err)
-				}
-				req.Header.Set("Content-Type", "application/json")
-
-				client := &http.Client{}
-				resp, err := client.Do(req)
-
-				if err != nil {
-					logs.Warn("Worker #%v POST failed: %s", w.WorkerNumber, err)
-				} else {
-					if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-						logs.Info("Worker #%v: POST succeeded with status %v on flush %v", w.WorkerNumber, resp.Status, w.totalCounter)
-					} else {
-						logs.Warn("Worker #%v: On flush %v, Post failed with status: %v", w.WorkerNumber, w.totalCounter, resp.StatusCode)
-						logs.Warn("rWorker #%v: esponse Status: %v", w.WorkerNumber, resp.Status)
-						body, _ := ioutil.ReadAll(resp.Body)
-						logs.Warn("Worker #%v: response Body: %v", w.WorkerNumber, string(body))
-					}
-					defer resp.Body.Close()
-				}
-				logs.Debug("Worker #%v: Bulk upload is complete", w.WorkerNumber)
-			}()
+			// wait for room, if too many bulk requests are outstanding
+			w.inFlight <- true
+			w.pending.Add(1)
+			go w.send(w.items[0:w.counter], events, w.totalCounter)
 		} else { // test mode: send to standout
 			str := strings.Join(w.items[0:w.counter], "\n") + "\n"
 			fmt.Print(str)
+			for _, obj := range events {
+				Ack(obj)
+			}
 		}
-		itemCount := ((w.totalCounter - 1) * int64(w.max)) + int64(w.counter/2)
-		if forceReport || (reportEvery > 0 && itemCount%reportEvery == 0) {
+		w.itemCount += int64(w.counter / 2)
+		itemCount := w.itemCount
+		if forceReport || (reportEvery > 0 && itemCount/reportEvery != (itemCount-int64(w.counter/2))/reportEvery) {
 			go func() {
 				now := time.Now()
 				var report struct {
@@ -296,6 +504,10 @@ func (w *ElasticSearchWorker) flush(forceReport bool) {
 					TimeSinceLastFlush float64 `json:"time_since_last_flush,omitempty"`
 					ItemsFlushed       int64   `json:"items_flushed,omitempty"`
 					ItemsPerSecond     float64 `json:"items_per_second,omitempty"`
+					ItemsSucceeded     int64   `json:"items_succeeded,omitempty"`
+					ItemsFailed        int64   `json:"items_failed,omitempty"`
+					BytesUncompressed  int64   `json:"bytes_uncompressed,omitempty"`
+					BytesSent          int64   `json:"bytes_sent,omitempty"`
 					LastItemCreated    string  `json:"last_item_created,omitempty"`
 				}
 				report.WorkerNumber = w.WorkerNumber
@@ -306,15 +518,231 @@ func (w *ElasticSearchWorker) flush(forceReport bool) {
 				report.ItemsFlushed = itemCount - w.lastCount
 				w.lastCount = itemCount
 				report.ItemsPerSecond = float64(report.ItemsFlushed) / report.TimeSinceLastFlush
-				itemsCreated := itemsCreated(body)
-				if len(itemsCreated) > 0 {
-					report.LastItemCreated = itemsCreated[len(itemsCreated)-1]
-				}
+				report.ItemsSucceeded = atomic.LoadInt64(&w.succeeded)
+				report.ItemsFailed = atomic.LoadInt64(&w.failed)
+				report.BytesUncompressed = w.BytesUncompressed()
+				report.BytesSent = w.BytesSent()
+				report.LastItemCreated, _ = w.lastCreated.Load().(string)
 				strReport, _ := json.Marshal(report)
 				logs.Info("%v", string(strReport))
 			}()
 		}
 		// now, clear out state
-		_ = w.Init()
+		w.reset()
+	}
+}
+
+// send posts a bulk request, retrying with backoff on another host when it
+// fails. Documents which Elasticsearch was too busy to take are retried on
+// their own; documents it rejects are dead-lettered. lines holds an action
+// and a document for each event.
+func (w *ElasticSearchWorker) send(lines []string, events []map[string]interface{}, flushNumber int64) {
+	defer func() {
+		<-w.inFlight
+		w.pending.Done()
+	}()
+	var succeeded, failed int
+	defer func() {
+		atomic.AddInt64(&w.succeeded, int64(succeeded))
+		atomic.AddInt64(&w.failed, int64(failed))
+		logs.Info("Worker #%v: flush %v: %v documents succeeded, %v failed", w.WorkerNumber, flushNumber, succeeded, failed)
+	}()
+	for attempt := 0; ; attempt++ {
+		host := w.NextHost()
+		var status int
+		var respBody []byte
+		setupErr := w.findVersion(host)
+		if setupErr == nil {
+			setupErr = w.bootstrap(host)
+		}
+		err := setupErr
+		if err == nil {
+			lines = w.typedActions(lines)
+			body := strings.Join(lines, "\n") + "\n"
+			w.HostPool.Begin(host)
+			status, respBody, err = w.post(host, []byte(body))
+			w.HostPool.Done(host)
+		}
+		switch {
+		case setupErr != nil:
+			logs.Warn("Worker #%v: On flush %v, unable to set up %s: %v", w.WorkerNumber, flushNumber, host, setupErr)
+		case err != nil:
+			logs.Warn("Worker #%v POST to %s failed: %s", w.WorkerNumber, host, err)
+			w.HostPool.MarkDead(host)
+		case status >= 200 && status <= 299:
+			logs.Debug("Worker #%v: POST succeeded with status %v on flush %v", w.WorkerNumber, status, flushNumber)
+			retry, retryLines, ok, rejected, readErr := w.checkItems(respBody, lines, events)
+			if readErr != nil {
+				logs.Warn("Worker #%v: On flush %v, unable to read the bulk response from %s: %v", w.WorkerNumber, flushNumber, host, readErr)
+				err = readErr
+				break
+			}
+			succeeded += ok
+			failed += rejected
+			if len(retry) == 0 {
+				logs.Debug("Worker #%v: Bulk upload is complete", w.WorkerNumber)
+				return
+			}
+			logs.Warn("Worker #%v: On flush %v, %v documents were rejected as Elasticsearch is busy", w.WorkerNumber, flushNumber, len(retry))
+			lines, events = retryLines, retry
+			err = fmt.Errorf("%v documents rejected as Elasticsearch is busy", len(retry))
+		case status == http.StatusTooManyRequests || status >= 500:
+			logs.Warn("Worker #%v: On flush %v, POST to %s failed with status %v: %s", w.WorkerNumber, flushNumber, host, status, respBody)
+			err = fmt.Errorf("status %v: %s", status, respBody)
+			if status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout {
+				w.HostPool.MarkDead(host)
+			}
+		default:
+			logs.Warn("Worker #%v: On flush %v, POST was rejected with status %v: %s", w.WorkerNumber, flushNumber, status, respBody)
+			w.deadLetter(events, ReasonRejected, fmt.Errorf("status %v: %s", status, respBody))
+			failed += len(events)
+			return
+		}
+		if w.retries >= 0 && attempt >= w.retries {
+			if !w.durable {
+				logs.Warn("Worker #%v: giving up on flush %v after %v attempts", w.WorkerNumber, flushNumber, attempt+1)
+				w.deadLetter(events, ReasonRetriesExhausted, err)
+				failed += len(events)
+				return
+			}
+			if attempt == w.retries {
+				logs.Warn("Worker #%v: flush %v failed %v times; retrying until it is delivered", w.WorkerNumber, flushNumber, attempt+1)
+			}
+		}
+		if !w.wait(attempt) {
+			logs.Warn("Worker #%v: stopping with flush %v undelivered; its %v events will be read again", w.WorkerNumber, flushNumber, len(events))
+			return
+		}
+	}
+}
+
+// checkItems goes through the results of a bulk request, acknowledging the
+// documents which were written, dead-lettering those which were rejected,
+// and returning those to retry. A response which is not a bulk response
+// for the documents sent (say, a page from a proxy) is an error, and
+// nothing is acknowledged.
+func (w *ElasticSearchWorker) checkItems(respBody []byte, lines []string, events []map[string]interface{}) (retry []map[string]interface{}, retryLines []string, succeeded int, failed int, err error) {
+	resp, err := ParseBulkResponse(respBody)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("not a bulk response: %v: %.200s", err, respBody)
+	}
+	if len(resp.Items) != len(events) {
+		return nil, nil, 0, 0, fmt.Errorf("%v results for %v documents: %.200s", len(resp.Items), len(events), respBody)
+	}
+	for i, obj := range events {
+		item, _ := resp.Result(i)
+		switch {
+		case item.Succeeded() || (w.action == ActionCreate && item.AlreadyExists()):
+			succeeded++
+			if item.ID != "" {
+				w.lastCreated.Store(item.ID)
+			}
+			Ack(obj)
+		case item.Retryable():
+			retry = append(retry, obj)
+			retryLines = append(retryLines, lines[2*i], lines[2*i+1])
+		default:
+			failed++
+			DeadLetterEvent(obj, ReasonBulkItemFailed, item.Err())
+			Ack(obj)
+		}
+	}
+	return
+}
+
+// post sends a bulk request to host, returning the status and the body of the response
+func (w *ElasticSearchWorker) post(host string, body []byte) (status int, respBody []byte, err error) {
+	atomic.AddInt64(&w.bytesUncompressed, int64(len(body)))
+	encoding := ""
+	if w.compression == CompressionGzip {
+		if body, err = gzipBody(body); err != nil {
+			return
+		}
+		encoding = CompressionGzip
+	}
+	atomic.AddInt64(&w.bytesSent, int64(len(body)))
+	return w.requestEncoded("POST", host, w.bulkPath, body, encoding)
+}
+
+// gzipBody compresses a request body
+func gzipBody(body []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// request sends a request with its credentials to path on host, returning
+// the status and the body of the response
+func (w *ElasticSearchWorker) request(method string, host string, path string, body []byte) (status int, respBody []byte, err error) {
+	return w.requestEncoded(method, host, path, body, "")
+}
+
+// requestEncoded sends a request whose body has the given Content-Encoding
+func (w *ElasticSearchWorker) requestEncoded(method string, host string, path string, body []byte, encoding string) (status int, respBody []byte, err error) {
+	req, err := http.NewRequest(method, w.hostURL(host, path), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	w.auth.Apply(req)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+// wait waits before retrying after attempt. Unless events which are not
+// delivered would be lost, it returns false as soon as the worker is stopped.
+func (w *ElasticSearchWorker) wait(attempt int) bool {
+	delay := w.backoffDelay(attempt)
+	if !w.durable {
+		time.Sleep(delay)
+		return true
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-w.stopping:
+		return false
+	}
+}
+
+// backoffDelay is how long to wait before retrying after attempt: it doubles
+// with each attempt, up to the maximum, and is jittered
+func (w *ElasticSearchWorker) backoffDelay(attempt int) time.Duration {
+	return backoffDelay(w.backoff, w.backoffMax, attempt)
+}
+
+// backoffDelay doubles the backoff with each attempt, up to max, with jitter
+func backoffDelay(backoff time.Duration, max time.Duration, attempt int) time.Duration {
+	delay := max
+	if attempt < 32 && backoff<<uint(attempt) < max {
+		delay = backoff << uint(attempt)
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// deadLetter dead-letters and acknowledges the events of a failed bulk request
+func (w *ElasticSearchWorker) deadLetter(events []map[string]interface{}, reason string, err error) {
+	for _, obj := range events {
+		DeadLetterEvent(obj, reason, err)
+		Ack(obj)
 	}
 }
@@ -0,0 +1,278 @@
+package worker
+
+/*
+	es_action.go renders the action and document lines of bulk requests.
+
+	Which lines are right depends on the cluster: Elasticsearch before 7
+	needs a _type on each action, while Elasticsearch 7 and 8 and OpenSearch
+	reject one. The version is given by es.version, or asked of the cluster
+	before the first bulk request, and again before each one until it
+	answers. Actions rendered before the version is known are given a _type
+	once it is, if they need one.
+	Documents may be created (which fails if their _id exists), indexed
+	(replacing any document with their _id) or updated (merged into it).
+	A data stream only takes creates, of documents with an @timestamp; an
+	event without one is given its time from es.timestamp_field.
+
+	Documents are given an _id from es.id_field, or hashed from the fields
+	named in es.id_hash_fields, so that sending them again does not write
+	them twice; otherwise Elasticsearch picks one.
+*/
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const (
+	key_es_version     = "es.version"
+	key_es_action      = "es.action"
+	key_es_data_stream = "es.data_stream"
+	key_es_id_field    = "es.id_field"
+	key_es_id_hash     = "es.id_hash_fields"
+)
+
+// Names for the metadata of an event in es.id_hash_fields: the line(s) it
+// was parsed from, the file they were read from, and their offset in it
+const (
+	HashFieldRaw    = "@raw"
+	HashFieldSource = "@source"
+	HashFieldOffset = "@offset"
+)
+
+// Bulk actions
+const (
+	ActionCreate = "create"
+	ActionIndex  = "index"
+	ActionUpdate = "update"
+)
+
+// DistributionOpenSearch is the version.distribution OpenSearch reports
+const DistributionOpenSearch = "opensearch"
+
+// DefaultElasticSearchVersion is the version assumed when the cluster will
+// not say
+const DefaultElasticSearchVersion = "7"
+
+// DataStreamTimestamp is the field every document of a data stream needs
+const DataStreamTimestamp = "@timestamp"
+
+// ReasonMissingTimestamp is the dead-letter reason for events sent to a data
+// stream without an @timestamp
+const ReasonMissingTimestamp = "missing_timestamp"
+
+// bulkActionMeta is the metadata of a bulk action
+type bulkActionMeta struct {
+	Index    string `json:"_index"`
+	Type     string `json:"_type,omitempty"`
+	ID       string `json:"_id,omitempty"`
+	Routing  string `json:"routing,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+// ConfiguredElasticSearchVersion is the version of the cluster, like "6.8",
+// "8" or "opensearch"; empty to ask the cluster
+func ConfiguredElasticSearchVersion() string {
+	return viper.GetString(key_es_version)
+}
+
+// ConfiguredElasticSearchAction is the bulk action: create, index or update
+func ConfiguredElasticSearchAction() string {
+	action := viper.GetString(key_es_action)
+	switch action {
+	case "":
+		return ActionCreate
+	case ActionCreate, ActionIndex, ActionUpdate:
+		return action
+	}
+	logs.Warn("Unknown Elasticsearch action %s; using %s", action, ActionCreate)
+	return ActionCreate
+}
+
+// ConfiguredElasticSearchDataStream is whether es.index is a data stream
+func ConfiguredElasticSearchDataStream() bool {
+	return viper.GetBool(key_es_data_stream)
+}
+
+// ConfiguredElasticSearchIDField is the event field used as the _id
+func ConfiguredElasticSearchIDField() string {
+	return viper.GetString(key_es_id_field)
+}
+
+// ConfiguredElasticSearchIDHashFields are the fields hashed into the _id
+func ConfiguredElasticSearchIDHashFields() []string {
+	return viper.GetStringSlice(key_es_id_hash)
+}
+
+// HashDocumentID hashes the named fields of an event into an _id. The
+// names HashFieldRaw, HashFieldSource and HashFieldOffset stand for the
+// event's metadata.
+func HashDocumentID(obj map[string]interface{}, fields []string) string {
+	meta := Metadata(obj)
+	if meta == nil {
+		meta = &EventMetadata{}
+	}
+	hash := sha1.New()
+	for _, field := range fields {
+		switch field {
+		case HashFieldRaw:
+			fmt.Fprint(hash, meta.Raw)
+		case HashFieldSource:
+			fmt.Fprint(hash, meta.Source)
+		case HashFieldOffset:
+			fmt.Fprint(hash, meta.Offset)
+		default:
+			if v, found := obj[field]; found {
+				fmt.Fprint(hash, v)
+			}
+		}
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// documentID is the _id of an event, or "" to let Elasticsearch pick one
+func (w *ElasticSearchWorker) documentID(obj map[string]interface{}) string {
+	if w.idField != "" {
+		if v, found := obj[w.idField]; found && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	if len(w.idHashFields) > 0 {
+		return HashDocumentID(obj, w.idHashFields)
+	}
+	return ""
+}
+
+// UsesDocumentType is whether a cluster of the given version needs a _type
+// on bulk actions: only Elasticsearch before 7 does
+func UsesDocumentType(version string) bool {
+	if isOpenSearch(version) {
+		return false
+	}
+	end := strings.IndexFunc(version, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(version)
+	}
+	major, err := strconv.Atoi(version[:end])
+	return err == nil && major < 7
+}
+
+// isOpenSearch is whether the version is of OpenSearch
+func isOpenSearch(version string) bool {
+	return strings.HasPrefix(strings.ToLower(version), DistributionOpenSearch)
+}
+
+// knownVersion is the version of the cluster, or "" until it is known
+func (w *ElasticSearchWorker) knownVersion() string {
+	w.versionLock.Lock()
+	defer w.versionLock.Unlock()
+	return w.version
+}
+
+// findVersion asks host for the version of the cluster, on its root
+// endpoint, unless it is known. It returns an error if the cluster could
+// not be reached or was too busy, so that the bulk request waits rather
+// than being sent for the wrong version. If the cluster will not say, say
+// for lack of privileges, DefaultElasticSearchVersion is assumed.
+func (w *ElasticSearchWorker) findVersion(host string) error {
+	w.versionLock.Lock()
+	defer w.versionLock.Unlock()
+	if w.version != "" {
+		return nil
+	}
+	status, body, err := w.request("GET", host, "/", nil)
+	switch {
+	case err != nil:
+		return fmt.Errorf("unable to ask %s for its version: %v", host, err)
+	case transientStatus(status):
+		return fmt.Errorf("unable to ask %s for its version: status %v: %s", host, status, body)
+	}
+	var root struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if status < 200 || status > 299 || json.Unmarshal(body, &root) != nil || root.Version.Number == "" {
+		logs.Warn("Unable to read the version from %s: status %v: %s; assuming %s", host, status, body, DefaultElasticSearchVersion)
+		w.version = DefaultElasticSearchVersion
+		return nil
+	}
+	logs.Info("Elasticsearch host %s is %s %s", host, root.Version.Distribution, root.Version.Number)
+	w.version = root.Version.Number
+	if root.Version.Distribution == DistributionOpenSearch {
+		w.version = DistributionOpenSearch + " " + root.Version.Number
+	}
+	return nil
+}
+
+// typedActions gives a _type to the actions of lines which were rendered
+// before the version of the cluster was known, if it needs one
+func (w *ElasticSearchWorker) typedActions(lines []string) []string {
+	if !UsesDocumentType(w.knownVersion()) {
+		return lines
+	}
+	typed := make([]string, len(lines))
+	copy(typed, lines)
+	for i := 0; i < len(typed); i += 2 {
+		var action map[string]bulkActionMeta
+		if json.Unmarshal([]byte(typed[i]), &action) != nil {
+			continue
+		}
+		for name, meta := range action {
+			if meta.Type == "" {
+				meta.Type = w.DocumentType()
+				action[name] = meta
+				line, _ := json.Marshal(action)
+				typed[i] = string(line)
+			}
+		}
+	}
+	return typed
+}
+
+// dataStreamTimestamp is the @timestamp of an event: its own, or else its
+// time from es.timestamp_field
+func (w *ElasticSearchWorker) dataStreamTimestamp(obj map[string]interface{}) (interface{}, bool) {
+	if ts, found := obj[DataStreamTimestamp]; found {
+		return ts, true
+	}
+	if when, ok := EventTime(obj[w.indexTemplate.TimestampField]); ok {
+		return when, true
+	}
+	return nil, false
+}
+
+// bulkLines renders the action and document lines for an event going to index
+func (w *ElasticSearchWorker) bulkLines(obj map[string]interface{}, index string) (action string, doc string, err error) {
+	meta := bulkActionMeta{Index: index, ID: w.documentID(obj), Routing: w.routing(obj), Pipeline: w.pipeline(obj)}
+	if UsesDocumentType(w.knownVersion()) {
+		meta.Type = w.DocumentType()
+	}
+	line, err := json.Marshal(map[string]bulkActionMeta{w.action: meta})
+	if err != nil {
+		return
+	}
+	action = string(line)
+	if w.action == ActionUpdate {
+		line, err = json.Marshal(map[string]interface{}{"doc": EventFields(obj), "doc_as_upsert": true})
+	} else if _, found := obj[DataStreamTimestamp]; w.dataStream && !found {
+		// the event may be shared with other sinks, so it is copied
+		doc := make(map[string]interface{}, len(obj)+1)
+		for k, v := range EventFields(obj) {
+			doc[k] = v
+		}
+		doc[DataStreamTimestamp], _ = w.dataStreamTimestamp(obj)
+		line, err = json.Marshal(doc)
+	} else {
+		line, err = MarshalEvent(obj)
+	}
+	return action, string(line), err
+}
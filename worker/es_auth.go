@@ -0,0 +1,127 @@
+package worker
+
+/*
+	es_auth.go holds the credentials and TLS settings for secured clusters.
+
+	Requests carry basic auth (es.username and es.password), an API key
+	(es.api_key, the base64 encoded "id:key") or a bearer token
+	(es.bearer_token). Each secret may instead be read from a file, as with
+	es.password_file, or from an environment variable, as with
+	es.password_env. Under [es.tls], ca_file trusts a CA bundle, cert_file
+	and key_file give a client certificate, and insecure_skip_verify turns
+	off checking the cluster's certificate.
+*/
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	key_es_username         = "es.username"
+	key_es_password         = "es.password"
+	key_es_api_key          = "es.api_key"
+	key_es_bearer_token     = "es.bearer_token"
+	key_es_tls_ca_file      = "es.tls.ca_file"
+	key_es_tls_cert_file    = "es.tls.cert_file"
+	key_es_tls_key_file     = "es.tls.key_file"
+	key_es_tls_insecure     = "es.tls.insecure_skip_verify"
+	secretFileSuffix        = "_file"
+	secretEnvironmentSuffix = "_env"
+)
+
+// EsAuth is the credentials sent with each request
+type EsAuth struct {
+	Username    string
+	Password    string
+	APIKey      string
+	BearerToken string
+}
+
+// ConfiguredSecret is the value of key, or else the contents of the file
+// named by key_file, or else the environment variable named by key_env
+func ConfiguredSecret(key string) (string, error) {
+	if value := viper.GetString(key); value != "" {
+		return value, nil
+	}
+	if fileName := viper.GetString(key + secretFileSuffix); fileName != "" {
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(contents)), nil
+	}
+	if name := viper.GetString(key + secretEnvironmentSuffix); name != "" {
+		value, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("environment variable %s for %s is not set", name, key)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+// ConfiguredElasticSearchAuth reads the configured credentials
+func ConfiguredElasticSearchAuth() (auth EsAuth, err error) {
+	auth.Username = viper.GetString(key_es_username)
+	if auth.Password, err = ConfiguredSecret(key_es_password); err != nil {
+		return
+	}
+	if auth.APIKey, err = ConfiguredSecret(key_es_api_key); err != nil {
+		return
+	}
+	auth.BearerToken, err = ConfiguredSecret(key_es_bearer_token)
+	return
+}
+
+// Apply adds the credentials to a request
+func (auth EsAuth) Apply(req *http.Request) {
+	switch {
+	case auth.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+auth.APIKey)
+	case auth.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+auth.BearerToken)
+	case auth.Username != "":
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+}
+
+// ConfiguredElasticSearchTLS builds the configured TLS settings, or returns
+// nil if there are none
+func ConfiguredElasticSearchTLS() (*tls.Config, error) {
+	caFile := viper.GetString(key_es_tls_ca_file)
+	certFile := viper.GetString(key_es_tls_cert_file)
+	keyFile := viper.GetString(key_es_tls_key_file)
+	insecure := viper.GetBool(key_es_tls_insecure)
+	if caFile == "" && certFile == "" && !insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+	}
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,88 @@
+package worker_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+func TestConfiguredSecret(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "password")
+	ioutil.WriteFile(fileName, []byte("from-file\n"), 0600)
+	viper.Set("es.password_file", fileName)
+	if secret, err := worker.ConfiguredSecret("es.password"); err != nil || secret != "from-file" {
+		t.Errorf("expected the secret from the file, got %q (%v)", secret, err)
+	}
+	os.Setenv("TRANSLOG_TEST_API_KEY", "from-env")
+	defer os.Unsetenv("TRANSLOG_TEST_API_KEY")
+	viper.Set("es.api_key_env", "TRANSLOG_TEST_API_KEY")
+	if secret, err := worker.ConfiguredSecret("es.api_key"); err != nil || secret != "from-env" {
+		t.Errorf("expected the secret from the environment, got %q (%v)", secret, err)
+	}
+	viper.Set("es.bearer_token_env", "TRANSLOG_TEST_UNSET")
+	if _, err := worker.ConfiguredSecret("es.bearer_token"); err == nil {
+		t.Errorf("expected an error for an unset environment variable")
+	}
+}
+
+func TestEsAuthApply(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:9200/", nil)
+	worker.EsAuth{APIKey: "aWQ6a2V5"}.Apply(req)
+	if req.Header.Get("Authorization") != "ApiKey aWQ6a2V5" {
+		t.Errorf("expected an ApiKey header, got %v", req.Header.Get("Authorization"))
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:9200/", nil)
+	worker.EsAuth{BearerToken: "token"}.Apply(req)
+	if req.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("expected a Bearer header, got %v", req.Header.Get("Authorization"))
+	}
+}
+
+func TestBulkBasicAuthOverTLS(t *testing.T) {
+	var authorized int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "elastic" || password != "changeme" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&authorized, 1)
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "https://")})
+	viper.Set("es.scheme", "https")
+	viper.Set("es.version", "8")
+	viper.Set("es.username", "elastic")
+	viper.Set("es.password", "changeme")
+	viper.Set("es.tls.ca_file", caFile)
+	sendOne(t)
+	if atomic.LoadInt32(&authorized) != 1 {
+		t.Errorf("expected an authorized bulk request over TLS")
+	}
+}
@@ -0,0 +1,432 @@
+package worker
+
+/*
+	es_bootstrap.go installs what the cluster needs before the first bulk
+	request, when es.bootstrap.enabled is set: a lifecycle policy, an index
+	template, and a write alias, so that fields keep one type from day to day
+	rather than whatever dynamic mapping first guessed.
+
+	The template may be supplied as a JSON file; otherwise it is generated
+	for parse.format. For regex, its fields are those of the parse
+	pattern(s): fields captured by a typed grok reference, like
+	%{NUMBER:bytes:int}, or by a numeric, IP or date grok pattern, get that
+	type (ignoring values which do not fit); all other fields are keywords.
+	Syslog has its known fields, and json, logfmt and kv events are left to
+	dynamic mapping, with strings as keywords.
+	The lifecycle policy (ILM, or ISM for OpenSearch) is supplied as a JSON
+	file. The write alias is created, pointing at <alias>-000001, if it does
+	not exist yet; es.index should then be the alias.
+*/
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const (
+	key_es_bootstrap_enabled           = "es.bootstrap.enabled"
+	key_es_bootstrap_template_name     = "es.bootstrap.template_name"
+	key_es_bootstrap_template_file     = "es.bootstrap.template_file"
+	key_es_bootstrap_template_priority = "es.bootstrap.template_priority"
+	key_es_bootstrap_index_patterns    = "es.bootstrap.index_patterns"
+	key_es_bootstrap_policy_name       = "es.bootstrap.policy_name"
+	key_es_bootstrap_policy_file       = "es.bootstrap.policy_file"
+	key_es_bootstrap_write_alias       = "es.bootstrap.write_alias"
+)
+
+// DefaultTemplateName is the default name of the index template
+const DefaultTemplateName = "translog"
+
+// DefaultTemplatePriority is the default priority of a composable index
+// template: above the 100 of the logs-*-* and metrics-*-* templates built
+// into Elasticsearch 8
+const DefaultTemplatePriority = 200
+
+// the formats accepted for date fields in generated templates
+const esDateFormat = "strict_date_optional_time||epoch_millis||yyyy-MM-dd HH:mm:ss||yyyy-MM-dd HH:mm:ss.SSS||yyyy-MM-dd HH:mm:ss,SSS||dd/MMM/yyyy:HH:mm:ss Z"
+
+// grokTypes are the mapping types of the fields of typed grok references
+var grokTypes = map[string]string{
+	"int":   "long",
+	"long":  "long",
+	"float": "double",
+}
+
+// grokPatternTypes are the mapping types of fields captured by grok patterns
+var grokPatternTypes = map[string]string{
+	"INT":               "long",
+	"POSINT":            "long",
+	"NONNEGINT":         "long",
+	"NUMBER":            "double",
+	"BASE10NUM":         "double",
+	"IP":                "ip",
+	"IPV4":              "ip",
+	"IPV6":              "ip",
+	"HTTPDATE":          "date",
+	"TIMESTAMP_ISO8601": "date",
+}
+
+// syslogFieldTypes are the mapping types of the fields of syslog events
+var syslogFieldTypes = map[string]string{
+	"priority":  "long",
+	"facility":  "long",
+	"severity":  "long",
+	"version":   "long",
+	"timestamp": "date",
+	"hostname":  "keyword",
+	"app_name":  "keyword",
+	"procid":    "keyword",
+	"msgid":     "keyword",
+	"message":   "keyword",
+}
+
+// typedGrokReference matches %{NAME}, %{NAME:field} and %{NAME:field:type}
+var typedGrokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::(\w+))?\}`)
+
+// namedGroup matches the named groups of a regular expression
+var namedGroup = regexp.MustCompile(`\(\?P<(\w+)>`)
+
+// EsBootstrap is what is installed in the cluster before the first bulk request
+type EsBootstrap struct {
+	TemplateName  string
+	Template      []byte // as supplied, or nil to generate one
+	Priority      int    // of a composable template
+	IndexPatterns []string
+	PolicyName    string
+	Policy        []byte
+	WriteAlias    string
+}
+
+// esBootstrapState is whether a cluster has been bootstrapped; its lock is
+// held while it is
+type esBootstrapState struct {
+	lock sync.Mutex
+	done bool
+}
+
+var esBootstrapLock sync.Mutex
+var esBootstraps = map[string]*esBootstrapState{}
+
+// ConfiguredElasticSearchBootstrap reads the bootstrap configuration, or
+// returns nil if it is not enabled. index is the es.index template, whose
+// literal start gives the default index pattern.
+func ConfiguredElasticSearchBootstrap(index string) (*EsBootstrap, error) {
+	if !viper.GetBool(key_es_bootstrap_enabled) {
+		return nil, nil
+	}
+	b := &EsBootstrap{
+		TemplateName:  viper.GetString(key_es_bootstrap_template_name),
+		Priority:      DefaultTemplatePriority,
+		IndexPatterns: viper.GetStringSlice(key_es_bootstrap_index_patterns),
+		PolicyName:    viper.GetString(key_es_bootstrap_policy_name),
+		WriteAlias:    viper.GetString(key_es_bootstrap_write_alias),
+	}
+	if b.TemplateName == "" {
+		b.TemplateName = DefaultTemplateName
+	}
+	if viper.IsSet(key_es_bootstrap_template_priority) {
+		b.Priority = viper.GetInt(key_es_bootstrap_template_priority)
+	}
+	if len(b.IndexPatterns) == 0 {
+		if b.WriteAlias != "" {
+			b.IndexPatterns = []string{b.WriteAlias + "-*"}
+		} else {
+			b.IndexPatterns = []string{strings.SplitN(index, "{", 2)[0] + "*"}
+		}
+	}
+	var err error
+	if fileName := viper.GetString(key_es_bootstrap_template_file); fileName != "" {
+		if b.Template, err = readJSONFile(fileName); err != nil {
+			return nil, err
+		}
+	}
+	if fileName := viper.GetString(key_es_bootstrap_policy_file); fileName != "" {
+		if b.PolicyName == "" {
+			b.PolicyName = b.TemplateName
+		}
+		if b.Policy, err = readJSONFile(fileName); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// readJSONFile reads a file, which must hold JSON
+func readJSONFile(fileName string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(contents) {
+		return nil, fmt.Errorf("%s does not hold JSON", fileName)
+	}
+	return contents, nil
+}
+
+// PatternFieldTypes finds the fields captured by patterns, and their
+// mapping types
+func PatternFieldTypes(patterns []string, grok *Grok) map[string]string {
+	fields := map[string]string{}
+	for _, pattern := range patterns {
+		grokFieldTypes(pattern, grok, fields, map[string]bool{})
+	}
+	return fields
+}
+
+func grokFieldTypes(pattern string, grok *Grok, fields map[string]string, expanding map[string]bool) {
+	for _, match := range namedGroup.FindAllStringSubmatch(pattern, -1) {
+		setFieldType(fields, match[1], "keyword")
+	}
+	for _, match := range typedGrokReference.FindAllStringSubmatch(pattern, -1) {
+		name, field, hint := match[1], match[2], match[3]
+		if field != "" {
+			switch {
+			case grokTypes[hint] != "":
+				setFieldType(fields, field, grokTypes[hint])
+			case grokPatternTypes[name] != "":
+				setFieldType(fields, field, grokPatternTypes[name])
+			default:
+				setFieldType(fields, field, "keyword")
+			}
+		}
+		if definition, found := grok.patterns[name]; found && !expanding[name] {
+			expanding[name] = true
+			grokFieldTypes(definition, grok, fields, expanding)
+			delete(expanding, name)
+		}
+	}
+}
+
+// setFieldType gives a field a type. A field captured as different types
+// by different patterns gets a type which holds both: double for numbers,
+// and keyword for anything else.
+func setFieldType(fields map[string]string, field string, fieldType string) {
+	existing, found := fields[field]
+	switch {
+	case !found || existing == fieldType:
+		fields[field] = fieldType
+	case (existing == "long" || existing == "double") && (fieldType == "long" || fieldType == "double"):
+		fields[field] = "double"
+	default:
+		fields[field] = "keyword"
+	}
+}
+
+// ConfiguredFieldTypes finds the fields of the events of the configured
+// parse.format, and their mapping types: those captured by the parse
+// pattern(s) for regex, and the known fields of syslog. The fields of json,
+// logfmt and kv events are not known.
+func ConfiguredFieldTypes() map[string]string {
+	switch strings.ToLower(viper.GetString(configParseFormat)) {
+	case "", FormatRegex:
+	case FormatSyslog, FormatRFC3164, FormatRFC5424:
+		fields := map[string]string{}
+		for field, fieldType := range syslogFieldTypes {
+			fields[field] = fieldType
+		}
+		return fields
+	default:
+		return map[string]string{}
+	}
+	var patterns []string
+	for _, named := range ConfiguredPatterns() {
+		if preset, found := Presets[named.Preset]; found {
+			patterns = append(patterns, preset.Pattern)
+		} else {
+			patterns = append(patterns, named.Pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		pattern := viper.GetString(configParsePattern)
+		if preset, found := Presets[viper.GetString(configParsePreset)]; found && pattern == "" {
+			pattern = preset.Pattern
+		}
+		if pattern == "" {
+			pattern = DefaultParseLogPattern
+		}
+		patterns = append(patterns, pattern)
+	}
+	return PatternFieldTypes(patterns, ConfiguredGrok())
+}
+
+// VersionAtLeast is whether a cluster of the given version is at least
+// major.minor. Any OpenSearch is taken to be.
+func VersionAtLeast(version string, major int, minor int) bool {
+	if isOpenSearch(version) {
+		return true
+	}
+	numbers := strings.SplitN(version, ".", 3)
+	versionMajor, err := strconv.Atoi(numbers[0])
+	if err != nil {
+		return false
+	}
+	versionMinor := 0
+	if len(numbers) > 1 {
+		versionMinor, _ = strconv.Atoi(numbers[1])
+	}
+	return versionMajor > major || (versionMajor == major && versionMinor >= minor)
+}
+
+// TemplatePath is where the index template is installed: a composable
+// template from Elasticsearch 7.8, or a legacy one before
+func (b *EsBootstrap) TemplatePath(version string) string {
+	if VersionAtLeast(version, 7, 8) {
+		return "/_index_template/" + b.TemplateName
+	}
+	return "/_template/" + b.TemplateName
+}
+
+// TemplateBody is the index template: as supplied, or generated with
+// mappings for fields
+func (b *EsBootstrap) TemplateBody(fields map[string]string, version string, docType string, dataStream bool) ([]byte, error) {
+	if b.Template != nil {
+		return b.Template, nil
+	}
+	properties := map[string]interface{}{}
+	for field, fieldType := range fields {
+		mapping := map[string]interface{}{"type": fieldType}
+		switch fieldType {
+		case "keyword":
+			mapping["ignore_above"] = 1024
+		case "date":
+			mapping["format"] = esDateFormat
+			mapping["ignore_malformed"] = true
+		default:
+			mapping["ignore_malformed"] = true
+		}
+		properties[field] = mapping
+	}
+	mappings := map[string]interface{}{
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{"strings_as_keywords": map[string]interface{}{
+				"match_mapping_type": "string",
+				"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+			}},
+		},
+		"properties": properties,
+	}
+	settings := map[string]interface{}{}
+	if b.PolicyName != "" && !isOpenSearch(version) {
+		// OpenSearch policies pick their indices with their own ism_template
+		settings["index.lifecycle.name"] = b.PolicyName
+	}
+	if b.WriteAlias != "" {
+		if isOpenSearch(version) {
+			settings["plugins.index_state_management.rollover_alias"] = b.WriteAlias
+		} else {
+			settings["index.lifecycle.rollover_alias"] = b.WriteAlias
+		}
+	}
+	if !VersionAtLeast(version, 7, 8) {
+		if UsesDocumentType(version) {
+			mappings = map[string]interface{}{docType: mappings}
+		}
+		return json.Marshal(map[string]interface{}{"index_patterns": b.IndexPatterns, "settings": settings, "mappings": mappings})
+	}
+	body := map[string]interface{}{
+		"index_patterns": b.IndexPatterns,
+		"priority":       b.Priority,
+		"template":       map[string]interface{}{"settings": settings, "mappings": mappings},
+	}
+	if dataStream {
+		body["data_stream"] = map[string]interface{}{}
+	}
+	return json.Marshal(body)
+}
+
+// PolicyPath is where the lifecycle policy is installed
+func (b *EsBootstrap) PolicyPath(version string) string {
+	if isOpenSearch(version) {
+		return "/_plugins/_ism/policies/" + b.PolicyName
+	}
+	return "/_ilm/policy/" + b.PolicyName
+}
+
+// bootstrap installs the lifecycle policy, the index template and the
+// write alias on host, once for all of the workers, before a bulk request.
+// It returns an error if the cluster could not be reached or was too busy,
+// so that the bulk request waits rather than creating an index with
+// whatever dynamic mapping guesses, and it is tried again before the next
+// one. A step the cluster rejects is logged, and not tried again.
+func (w *ElasticSearchWorker) bootstrap(host string) error {
+	b := w.bootstrapConfig
+	if b == nil {
+		return nil
+	}
+	key := b.TemplateName + " " + strings.Join(w.hosts, ",")
+	esBootstrapLock.Lock()
+	state, found := esBootstraps[key]
+	if !found {
+		state = &esBootstrapState{}
+		esBootstraps[key] = state
+	}
+	esBootstrapLock.Unlock()
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.done {
+		return nil
+	}
+	version := w.knownVersion()
+	if b.Policy != nil {
+		if err := w.bootstrapPut(host, "lifecycle policy", b.PolicyPath(version), b.Policy); err != nil {
+			return err
+		}
+	}
+	template, err := b.TemplateBody(ConfiguredFieldTypes(), version, w.DocumentType(), w.dataStream)
+	if err != nil {
+		logs.Warn("Unable to generate the index template: %v", err)
+	} else if err := w.bootstrapPut(host, "index template", b.TemplatePath(version), template); err != nil {
+		return err
+	}
+	if b.WriteAlias != "" {
+		status, respBody, err := w.request("HEAD", host, "/_alias/"+b.WriteAlias, nil)
+		switch {
+		case err != nil:
+			return fmt.Errorf("unable to check for write alias %s: %v", b.WriteAlias, err)
+		case transientStatus(status):
+			return fmt.Errorf("unable to check for write alias %s: status %v: %s", b.WriteAlias, status, respBody)
+		case status == http.StatusNotFound:
+			body, _ := json.Marshal(map[string]interface{}{
+				"aliases": map[string]interface{}{b.WriteAlias: map[string]interface{}{"is_write_index": true}},
+			})
+			if err := w.bootstrapPut(host, "write alias", "/"+b.WriteAlias+"-000001", body); err != nil {
+				return err
+			}
+		case status < 200 || status > 299:
+			logs.Warn("Unable to check for write alias %s: status %v", b.WriteAlias, status)
+		}
+	}
+	state.done = true
+	return nil
+}
+
+// bootstrapPut installs one thing, logging how it went. It returns an error
+// if it may be installed by trying again.
+func (w *ElasticSearchWorker) bootstrapPut(host string, what string, path string, body []byte) error {
+	status, respBody, err := w.request("PUT", host, path, body)
+	switch {
+	case err != nil:
+		return fmt.Errorf("unable to install %s %s: %v", what, path, err)
+	case transientStatus(status):
+		return fmt.Errorf("unable to install %s %s: status %v: %s", what, path, status, respBody)
+	case status < 200 || status > 299:
+		logs.Warn("Unable to install %s %s: status %v: %s", what, path, status, respBody)
+	default:
+		logs.Info("Installed %s %s", what, path)
+	}
+	return nil
+}
+
+// transientStatus is whether a request which failed with status may
+// succeed if it is tried again
+func transientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
@@ -0,0 +1,211 @@
+package worker_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+func TestPatternFieldTypes(t *testing.T) {
+	fields := worker.PatternFieldTypes([]string{
+		`%{IP:client} %{NUMBER:bytes:int} %{NUMBER:duration} \[%{HTTPDATE:created}\] (?P<message>.*)`,
+		`%{COMMONAPACHELOG}`,
+	}, worker.NewGrok())
+	expected := map[string]string{
+		"client":   "keyword", // an IP in one pattern, and a host in the other
+		"bytes":    "double",  // an int in one pattern, and a number in the other
+		"duration": "double",
+		"created":  "date",
+		"message":  "keyword",
+		"method":   "keyword",
+		"status":   "double",
+	}
+	for field, fieldType := range expected {
+		if fields[field] != fieldType {
+			t.Errorf("expected %s to be a %s, got %v", field, fieldType, fields[field])
+		}
+	}
+}
+
+func TestConfiguredFieldTypes(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("parse.pattern", `%{IP:client} %{NUMBER:bytes:int}`)
+	for format, expected := range map[string]map[string]string{
+		"":        {"client": "ip", "bytes": "long"},
+		"regex":   {"client": "ip", "bytes": "long"},
+		"syslog":  {"timestamp": "date", "severity": "long", "hostname": "keyword"},
+		"rfc5424": {"timestamp": "date", "severity": "long", "hostname": "keyword"},
+		"json":    {},
+		"logfmt":  {},
+		"kv":      {},
+	} {
+		viper.Set("parse.format", format)
+		fields := worker.ConfiguredFieldTypes()
+		for field, fieldType := range expected {
+			if fields[field] != fieldType {
+				t.Errorf("for format %q, expected %s to be a %s, got %v", format, field, fieldType, fields[field])
+			}
+		}
+		if len(expected) == 0 && len(fields) != 0 {
+			t.Errorf("for format %q, expected no fields from the pattern, got %v", format, fields)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	versions := map[string]bool{"7.8.0": true, "7.7.1": false, "8.0.0": true, "6.8": false, "opensearch 1.3.0": true, "": false}
+	for version, expected := range versions {
+		if worker.VersionAtLeast(version, 7, 8) != expected {
+			t.Errorf("expected VersionAtLeast(%q, 7, 8) to be %v", version, expected)
+		}
+	}
+}
+
+func TestTemplateBodyLegacy(t *testing.T) {
+	b := &worker.EsBootstrap{TemplateName: "translog", IndexPatterns: []string{"analytics*"}}
+	body, err := b.TemplateBody(map[string]string{"bytes": "long"}, "6.8.0", "event", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template struct {
+		Mappings map[string]struct {
+			Properties map[string]map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	json.Unmarshal(body, &template)
+	if template.Mappings["event"].Properties["bytes"]["type"] != "long" {
+		t.Errorf("expected a legacy template with mappings by document type, got %s", body)
+	}
+	if b.TemplatePath("6.8.0") != "/_template/translog" {
+		t.Errorf("expected a legacy template path, got %v", b.TemplatePath("6.8.0"))
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	var lock sync.Mutex
+	requests := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		requests[r.Method+" "+r.URL.Path] = string(body)
+		lock.Unlock()
+		switch {
+		case r.Method == "HEAD":
+			rw.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/_bulk":
+			rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+		default:
+			rw.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.json")
+	ioutil.WriteFile(policyFile, []byte(`{"policy":{"phases":{"hot":{"actions":{"rollover":{"max_age":"1d"}}}}}}`), 0600)
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8.11.0")
+	viper.Set("es.index", "weblogs")
+	viper.Set("parse.pattern", `%{IP:client} %{NUMBER:bytes:int}`)
+	viper.Set("es.bootstrap.enabled", true)
+	viper.Set("es.bootstrap.template_name", "weblogs-test")
+	viper.Set("es.bootstrap.policy_file", policyFile)
+	viper.Set("es.bootstrap.write_alias", "weblogs")
+	sendOne(t)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if _, found := requests["PUT /_ilm/policy/weblogs-test"]; !found {
+		t.Errorf("expected the lifecycle policy to be installed, got %v", requests)
+	}
+	template := requests["PUT /_index_template/weblogs-test"]
+	if !strings.Contains(template, `"bytes":{"ignore_malformed":true,"type":"long"}`) || !strings.Contains(template, `"index.lifecycle.rollover_alias":"weblogs"`) || !strings.Contains(template, `"priority":200`) {
+		t.Errorf("expected a generated index template, got %v", template)
+	}
+	if alias := requests["PUT /weblogs-000001"]; !strings.Contains(alias, `"is_write_index":true`) {
+		t.Errorf("expected the write alias to be created, got %v", requests)
+	}
+	if _, found := requests["POST /_bulk"]; !found {
+		t.Errorf("expected the bulk request after bootstrapping, got %v", requests)
+	}
+}
+
+func TestBootstrapRetriedBeforeBulk(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		count := len(requests)
+		lock.Unlock()
+		switch {
+		case r.URL.Path == "/_bulk":
+			rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+		case count == 1:
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			rw.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+	defer server.Close()
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8.11.0")
+	viper.Set("es.index", "retried")
+	viper.Set("es.retry_backoff", 1)
+	viper.Set("es.bootstrap.enabled", true)
+	viper.Set("es.bootstrap.template_name", "retried-test")
+	sendOne(t)
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []string{"PUT /_index_template/retried-test", "PUT /_index_template/retried-test", "POST /_bulk"}
+	if strings.Join(requests, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected the template to be installed again before the bulk request, got %v", requests)
+	}
+}
+
+func TestBootstrapRejectionIsFinal(t *testing.T) {
+	var puts int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			atomic.AddInt32(&puts, 1)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8.11.0")
+	viper.Set("es.index", "rejected")
+	viper.Set("es.max", 1)
+	viper.Set("es.bootstrap.enabled", true)
+	viper.Set("es.bootstrap.template_name", "rejected-test")
+	sendEvents(t, 10)
+	if atomic.LoadInt32(&puts) != 1 {
+		t.Errorf("expected a rejected template to be installed once, got %v requests", puts)
+	}
+}
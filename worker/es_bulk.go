@@ -0,0 +1,82 @@
+package worker
+
+/*
+	es_bulk.go decodes the responses to bulk requests. Elasticsearch answers
+	a bulk request with 200 even when some of its documents were rejected;
+	each document has its own status in the items of the response.
+*/
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// BulkResponse is the response to a bulk request
+type BulkResponse struct {
+	Took   int                   `json:"took"`
+	Errors bool                  `json:"errors"`
+	Items  []map[string]BulkItem `json:"items"`
+}
+
+// BulkItem is the result for one document of a bulk request
+type BulkItem struct {
+	Index  string     `json:"_index"`
+	ID     string     `json:"_id"`
+	Status int        `json:"status"`
+	Error  *BulkError `json:"error,omitempty"`
+}
+
+// BulkError is why a document was rejected
+type BulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Reason)
+}
+
+// ParseBulkResponse decodes the body of a response to a bulk request
+func ParseBulkResponse(body []byte) (*BulkResponse, error) {
+	var resp BulkResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Result returns the result of the i'th document, whatever its action was
+func (r *BulkResponse) Result(i int) (item BulkItem, found bool) {
+	if i >= len(r.Items) {
+		return
+	}
+	for _, item = range r.Items[i] {
+		return item, true
+	}
+	return
+}
+
+// Succeeded is whether the document was written
+func (item BulkItem) Succeeded() bool {
+	return item.Status >= 200 && item.Status <= 299
+}
+
+// AlreadyExists is whether a document was not created because one with its
+// _id already was, as when a request is sent again
+func (item BulkItem) AlreadyExists() bool {
+	return item.Status == http.StatusConflict && item.Error != nil && item.Error.Type == "version_conflict_engine_exception"
+}
+
+// Retryable is whether the document was rejected only because Elasticsearch
+// was too busy, so that it may be sent again
+func (item BulkItem) Retryable() bool {
+	return item.Status == http.StatusTooManyRequests || item.Status == http.StatusServiceUnavailable
+}
+
+// Err is why the document was rejected
+func (item BulkItem) Err() error {
+	if item.Error != nil {
+		return item.Error
+	}
+	return fmt.Errorf("status %v", item.Status)
+}
@@ -0,0 +1,238 @@
+package worker
+
+/*
+	es_hosts.go keeps track of which of the Elasticsearch hosts are up.
+
+	A host which fails a bulk request is marked dead, and is left out when
+	choosing where to send the next one. Dead hosts are health checked every
+	so often, and resurrected once a check succeeds. If every host is dead,
+	all of them are tried anyway. The pool also counts the requests in
+	flight to each host, and its hosts may be replaced by those sniffed
+	from the cluster. The workers of a sink share one pool, so that a host
+	is checked once, and the requests in flight are those of every worker.
+*/
+import (
+	"sync"
+	"time"
+
+	"github.com/fizx/logs"
+)
+
+// esHost is an Elasticsearch host, and whether it is thought to be down
+type esHost struct {
+	name      string
+	dead      bool
+	deadSince time.Time
+	inFlight  int
+}
+
+// EsHostPool is a set of Elasticsearch hosts, some of which may be dead
+type EsHostPool struct {
+	lock       sync.Mutex
+	hosts      []*esHost
+	sharers    int
+	stopChecks chan bool
+}
+
+// NewEsHostPool creates a pool of hosts, all thought to be up
+func NewEsHostPool(names []string) *EsHostPool {
+	p := &EsHostPool{}
+	for _, name := range names {
+		p.hosts = append(p.hosts, &esHost{name: name})
+	}
+	return p
+}
+
+// seed gives the pool its hosts, unless it has some already: a pool shared
+// by the workers of a sink is created before they read their configuration,
+// and its hosts may have been sniffed by the time the last of them does
+func (p *EsHostPool) seed(names []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.hosts) > 0 {
+		return
+	}
+	for _, name := range names {
+		p.hosts = append(p.hosts, &esHost{name: name})
+	}
+}
+
+// share counts a worker using the pool. The first gets a channel, on which
+// to stop checking the hosts, which is closed once every worker has
+// stopped; the others get nil.
+func (p *EsHostPool) share() chan bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sharers++
+	if p.sharers > 1 {
+		return nil
+	}
+	p.stopChecks = make(chan bool)
+	return p.stopChecks
+}
+
+// unshare counts a worker as having stopped using the pool
+func (p *EsHostPool) unshare() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sharers--
+	if p.sharers == 0 && p.stopChecks != nil {
+		close(p.stopChecks)
+		p.stopChecks = nil
+	}
+}
+
+// Live returns the hosts which are up, or all of the hosts if none are
+func (p *EsHostPool) Live() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var live, all []string
+	for _, host := range p.hosts {
+		all = append(all, host.name)
+		if !host.dead {
+			live = append(live, host.name)
+		}
+	}
+	if len(live) == 0 {
+		return all
+	}
+	return live
+}
+
+// Dead returns the hosts which are down
+func (p *EsHostPool) Dead() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var dead []string
+	for _, host := range p.hosts {
+		if host.dead {
+			dead = append(dead, host.name)
+		}
+	}
+	return dead
+}
+
+// MarkDead marks a host as down
+func (p *EsHostPool) MarkDead(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, host := range p.hosts {
+		if host.name == name && !host.dead {
+			logs.Warn("Marking Elasticsearch host %s as dead", name)
+			host.dead = true
+			host.deadSince = time.Now()
+		}
+	}
+}
+
+// MarkAlive marks a host as up
+func (p *EsHostPool) MarkAlive(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, host := range p.hosts {
+		if host.name == name && host.dead {
+			logs.Info("Resurrecting Elasticsearch host %s, dead since %v", name, host.deadSince)
+			host.dead = false
+		}
+	}
+}
+
+// HealthCheck checks each of the dead hosts, and resurrects those which pass
+func (p *EsHostPool) HealthCheck(check func(host string) bool) {
+	for _, host := range p.Dead() {
+		if check(host) {
+			p.MarkAlive(host)
+		}
+	}
+}
+
+// HealthCheckEvery checks the dead hosts every interval, until quit is closed
+func (p *EsHostPool) HealthCheckEvery(interval time.Duration, check func(host string) bool, quit chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.HealthCheck(check)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Begin counts a request sent to a host
+func (p *EsHostPool) Begin(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, host := range p.hosts {
+		if host.name == name {
+			host.inFlight++
+		}
+	}
+}
+
+// Done counts a request to a host as finished
+func (p *EsHostPool) Done(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, host := range p.hosts {
+		if host.name == name && host.inFlight > 0 {
+			host.inFlight--
+		}
+	}
+}
+
+// LeastInFlight returns the live host with the fewest requests in flight.
+// Ties go to the first such host at or after start, so that an idle pool
+// is used in turn.
+func (p *EsHostPool) LeastInFlight(start int) string {
+	live := p.Live()
+	if len(live) == 0 {
+		return ""
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	inFlight := make(map[string]int, len(p.hosts))
+	for _, host := range p.hosts {
+		inFlight[host.name] = host.inFlight
+	}
+	best := ""
+	for i := range live {
+		name := live[(start+i)%len(live)]
+		if best == "" || inFlight[name] < inFlight[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+// SetHosts replaces the hosts of the pool. Hosts already in it keep their
+// state.
+func (p *EsHostPool) SetHosts(names []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	known := make(map[string]*esHost, len(p.hosts))
+	for _, host := range p.hosts {
+		known[host.name] = host
+	}
+	hosts := make([]*esHost, 0, len(names))
+	kept := make(map[string]bool, len(names))
+	for _, name := range names {
+		if kept[name] {
+			continue
+		}
+		kept[name] = true
+		host, found := known[name]
+		if !found {
+			logs.Info("Adding Elasticsearch host %s", name)
+			host = &esHost{name: name}
+		}
+		hosts = append(hosts, host)
+	}
+	for name := range known {
+		if !kept[name] {
+			logs.Info("Removing Elasticsearch host %s", name)
+		}
+	}
+	p.hosts = hosts
+}
@@ -0,0 +1,69 @@
+package worker_test
+
+import (
+	"testing"
+
+	"github.com/willf/translog/worker"
+)
+
+func TestEsHostPoolMarkDead(t *testing.T) {
+	p := worker.NewEsHostPool([]string{"alpha", "beta"})
+	p.MarkDead("alpha")
+	if live := p.Live(); len(live) != 1 || live[0] != "beta" {
+		t.Errorf("expected only beta to be live, got %v", live)
+	}
+	if dead := p.Dead(); len(dead) != 1 || dead[0] != "alpha" {
+		t.Errorf("expected alpha to be dead, got %v", dead)
+	}
+}
+
+func TestEsHostPoolAllDead(t *testing.T) {
+	p := worker.NewEsHostPool([]string{"alpha", "beta"})
+	p.MarkDead("alpha")
+	p.MarkDead("beta")
+	if live := p.Live(); len(live) != 2 {
+		t.Errorf("expected every host to be tried when all are dead, got %v", live)
+	}
+}
+
+func TestEsHostPoolHealthCheck(t *testing.T) {
+	p := worker.NewEsHostPool([]string{"alpha", "beta", "gamma"})
+	p.MarkDead("alpha")
+	p.MarkDead("beta")
+	p.HealthCheck(func(host string) bool { return host == "beta" })
+	if dead := p.Dead(); len(dead) != 1 || dead[0] != "alpha" {
+		t.Errorf("expected beta to be resurrected, got dead %v", dead)
+	}
+}
+
+func TestEsHostPoolLeastInFlight(t *testing.T) {
+	p := worker.NewEsHostPool([]string{"alpha", "beta", "gamma"})
+	p.Begin("alpha")
+	p.Begin("beta")
+	p.Begin("beta")
+	if host := p.LeastInFlight(0); host != "gamma" {
+		t.Errorf("expected the idle host gamma, got %v", host)
+	}
+	p.Begin("gamma")
+	p.Begin("gamma")
+	p.Done("beta")
+	if host := p.LeastInFlight(2); host != "alpha" {
+		t.Errorf("expected a tie to go to the first host at or after the start, got %v", host)
+	}
+	p.MarkDead("alpha")
+	if host := p.LeastInFlight(0); host != "beta" {
+		t.Errorf("expected a dead host to be passed over, got %v", host)
+	}
+}
+
+func TestEsHostPoolSetHosts(t *testing.T) {
+	p := worker.NewEsHostPool([]string{"alpha", "beta"})
+	p.MarkDead("alpha")
+	p.SetHosts([]string{"alpha", "gamma", "gamma"})
+	if dead := p.Dead(); len(dead) != 1 || dead[0] != "alpha" {
+		t.Errorf("expected alpha to stay dead, got dead %v", dead)
+	}
+	if live := p.Live(); len(live) != 1 || live[0] != "gamma" {
+		t.Errorf("expected beta to be replaced by gamma, got %v", live)
+	}
+}
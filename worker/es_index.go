@@ -0,0 +1,210 @@
+package worker
+
+/*
+	es_index.go names the index each event is written to, from the es.index
+	template. The template may hold {field}, replaced by the event's field,
+	and {field:layout}, replaced by the event's time in field formatted by
+	the Go time layout, like {created:2006.01.02}; {:layout} uses the time in
+	es.timestamp_field. So "logs-{service}-{created:2006.01.02}" sends events
+	to an index per service and day. Times are formatted in es.timezone.
+	Characters Elasticsearch does not allow in index names are replaced by
+	_ in the values of fields, and those it does not allow at the start of
+	one are left out there.
+
+	If a field is missing, or is not a time, the event goes to the index
+	es.index_fallback; if that is not set, the current time is used instead
+	of a missing time, and "unknown" instead of any other missing field.
+*/
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const (
+	key_es_timestamp_field = "es.timestamp_field"
+	key_es_timezone        = "es.timezone"
+	key_es_index_fallback  = "es.index_fallback"
+)
+
+// DefaultTimestampField is the default field holding an event's time
+const DefaultTimestampField = "created"
+
+// MissingIndexField replaces a missing field in an index name, without a fallback
+const MissingIndexField = "unknown"
+
+// indexNameReplacer replaces the characters Elasticsearch does not allow in
+// index names
+var indexNameReplacer = strings.NewReplacer(
+	" ", "_", "/", "_", "\\", "_", "*", "_", "?", "_", "\"", "_",
+	"<", "_", ">", "_", "|", "_", ",", "_", "#", "_", ":", "_",
+)
+
+// indexPart is a literal part of an index template, or a placeholder
+type indexPart struct {
+	literal     string
+	field       string
+	layout      string
+	placeholder bool
+}
+
+// IndexTemplate names indices from the fields of events
+type IndexTemplate struct {
+	Template       string
+	TimestampField string
+	Location       *time.Location
+	Fallback       string
+	KeepCase       bool // index names must be lower case, but not all names
+	parts          []indexPart
+}
+
+// ConfiguredElasticSearchTimestampField is the field holding an event's time
+func ConfiguredElasticSearchTimestampField() string {
+	if field := viper.GetString(key_es_timestamp_field); field != "" {
+		return field
+	}
+	return DefaultTimestampField
+}
+
+// ConfiguredElasticSearchTimezone is the location in which index times are formatted
+func ConfiguredElasticSearchTimezone() *time.Location {
+	name := viper.GetString(key_es_timezone)
+	if name == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		logs.Warn("Unknown time zone %s; using Local: %v", name, err)
+		return time.Local
+	}
+	return location
+}
+
+// ConfiguredElasticSearchIndexFallback is the index used when an event
+// lacks a field of the template
+func ConfiguredElasticSearchIndexFallback() string {
+	return viper.GetString(key_es_index_fallback)
+}
+
+// NewIndexTemplate parses an index template
+func NewIndexTemplate(template string, timestampField string, location *time.Location, fallback string) *IndexTemplate {
+	t := &IndexTemplate{Template: template, TimestampField: timestampField, Location: location, Fallback: fallback}
+	rest := template
+	for rest != "" {
+		start := strings.Index(rest, "{")
+		end := -1
+		if start >= 0 {
+			end = strings.Index(rest[start:], "}")
+		}
+		if end < 0 {
+			t.parts = append(t.parts, indexPart{literal: rest})
+			break
+		}
+		end += start
+		if start > 0 {
+			t.parts = append(t.parts, indexPart{literal: rest[:start]})
+		}
+		part := indexPart{field: rest[start+1 : end], placeholder: true}
+		if colon := strings.Index(part.field, ":"); colon >= 0 {
+			part.field, part.layout = part.field[:colon], part.field[colon+1:]
+			if part.field == "" {
+				part.field = timestampField
+			}
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[end+1:]
+	}
+	return t
+}
+
+// Render names the index for an event
+func (t *IndexTemplate) Render(obj map[string]interface{}) string {
+	if index, ok := t.render(obj, false); ok {
+		return index
+	}
+	if t.Fallback != "" {
+		return t.Fallback
+	}
+	index, _ := t.render(obj, true)
+	return index
+}
+
+// RenderFields renders the template for an event, or returns false if the
+// event lacks one of its fields
+func (t *IndexTemplate) RenderFields(obj map[string]interface{}) (string, bool) {
+	return t.render(obj, false)
+}
+
+// render renders the template. If lenient, the current time stands in for
+// a missing time, and "unknown" for any other missing field.
+func (t *IndexTemplate) render(obj map[string]interface{}, lenient bool) (string, bool) {
+	var index []byte
+	for _, part := range t.parts {
+		if !part.placeholder {
+			index = append(index, part.literal...)
+			continue
+		}
+		v, found := obj[part.field]
+		if part.layout != "" {
+			when, ok := EventTime(v)
+			if !ok {
+				if !lenient {
+					return "", false
+				}
+				when = time.Now()
+			}
+			index = append(index, when.In(t.Location).Format(part.layout)...)
+			continue
+		}
+		if !found || v == nil {
+			if !lenient {
+				return "", false
+			}
+			v = MissingIndexField
+		}
+		value := fmt.Sprint(v)
+		if !t.KeepCase {
+			value = strings.ToLower(indexNameReplacer.Replace(value))
+			if len(index) == 0 {
+				value = strings.TrimLeft(value, "-_+")
+			}
+		}
+		index = append(index, value...)
+	}
+	return string(index), true
+}
+
+// EventTime reads a time from an event field: a time, a string in RFC 3339
+// format, or a number of seconds (or, if large, milliseconds) since the epoch
+func EventTime(v interface{}) (time.Time, bool) {
+	var seconds float64
+	switch value := v.(type) {
+	case time.Time:
+		return value, true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		return t, err == nil
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = f
+	case int64:
+		seconds = float64(value)
+	case int:
+		seconds = float64(value)
+	case float64:
+		seconds = value
+	default:
+		return time.Time{}, false
+	}
+	if seconds > 1e11 {
+		seconds /= 1000
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
@@ -0,0 +1,66 @@
+package worker_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/willf/translog/worker"
+)
+
+func TestIndexTemplateRender(t *testing.T) {
+	created := time.Date(2016, 4, 1, 23, 30, 0, 0, time.UTC)
+	template := worker.NewIndexTemplate("logs-{service}-{created:2006.01.02}", "created", time.UTC, "")
+	index := template.Render(map[string]interface{}{"service": "Web", "created": created})
+	if index != "logs-web-2016.04.01" {
+		t.Errorf("expected logs-web-2016.04.01, got %v", index)
+	}
+}
+
+func TestIndexTemplateReplacesForbiddenCharacters(t *testing.T) {
+	template := worker.NewIndexTemplate("logs-{source}", "created", time.UTC, "")
+	index := template.Render(map[string]interface{}{"source": `/var/log/My App|"x"*?<a>,b#c:d\e`})
+	if index != "logs-_var_log_my_app__x____a__b_c_d_e" {
+		t.Errorf("expected forbidden characters to be replaced, got %v", index)
+	}
+	template = worker.NewIndexTemplate("{service}-logs", "created", time.UTC, "")
+	if index := template.Render(map[string]interface{}{"service": "_-+web"}); index != "web-logs" {
+		t.Errorf("expected the characters an index may not start with to be left out, got %v", index)
+	}
+}
+
+func TestIndexTemplateTimezone(t *testing.T) {
+	created := time.Date(2016, 4, 1, 23, 30, 0, 0, time.UTC)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	template := worker.NewIndexTemplate("logs-{:2006.01.02}", "created", tokyo, "")
+	if index := template.Render(map[string]interface{}{"created": created}); index != "logs-2016.04.02" {
+		t.Errorf("expected logs-2016.04.02, got %v", index)
+	}
+}
+
+func TestIndexTemplateFallback(t *testing.T) {
+	template := worker.NewIndexTemplate("logs-{service}-{created:2006.01.02}", "created", time.UTC, "logs-unsorted")
+	if index := template.Render(map[string]interface{}{"service": "web"}); index != "logs-unsorted" {
+		t.Errorf("expected the fallback index, got %v", index)
+	}
+	template = worker.NewIndexTemplate("logs-{service}", "created", time.UTC, "")
+	if index := template.Render(map[string]interface{}{}); index != "logs-unknown" {
+		t.Errorf("expected logs-unknown, got %v", index)
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	expected := time.Date(2016, 4, 1, 11, 0, 0, 0, time.UTC)
+	values := []interface{}{expected, "2016-04-01T11:00:00Z", expected.Unix(), json.Number("1459508400000")}
+	for _, v := range values {
+		if when, ok := worker.EventTime(v); !ok || !when.Equal(expected) {
+			t.Errorf("expected %v to be read as %v, got %v", v, expected, when)
+		}
+	}
+	if _, ok := worker.EventTime("yesterday"); ok {
+		t.Errorf("expected yesterday not to be read as a time")
+	}
+}
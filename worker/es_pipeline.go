@@ -0,0 +1,103 @@
+package worker
+
+/*
+	es_pipeline.go adds the ingest pipeline, routing and refresh parameters
+	to bulk requests, so that enrichment can be left to pipelines already
+	set up in the cluster.
+
+	es.pipeline is the default pipeline, and es.refresh whether to refresh
+	the affected shards; both are sent on the URL of each bulk request.
+	es.pipeline_template picks a pipeline for each event from its fields,
+	like "{service}-logs", with the same placeholders as es.index; an event
+	missing one of them goes through the default pipeline. es.routing_field
+	names the field whose value routes an event to a shard. Updates do not
+	go through pipelines.
+*/
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const (
+	key_es_pipeline          = "es.pipeline"
+	key_es_pipeline_template = "es.pipeline_template"
+	key_es_routing_field     = "es.routing_field"
+	key_es_refresh           = "es.refresh"
+)
+
+// Values of es.refresh
+const (
+	RefreshTrue    = "true"
+	RefreshFalse   = "false"
+	RefreshWaitFor = "wait_for"
+)
+
+// ConfiguredElasticSearchPipeline is the default ingest pipeline, or "" for none
+func ConfiguredElasticSearchPipeline() string {
+	return viper.GetString(key_es_pipeline)
+}
+
+// ConfiguredElasticSearchPipelineTemplate is the template naming the
+// pipeline of each event, or "" to use the default pipeline for all
+func ConfiguredElasticSearchPipelineTemplate() string {
+	return viper.GetString(key_es_pipeline_template)
+}
+
+// ConfiguredElasticSearchRoutingField is the event field used for routing
+func ConfiguredElasticSearchRoutingField() string {
+	return viper.GetString(key_es_routing_field)
+}
+
+// ConfiguredElasticSearchRefresh is the refresh parameter of bulk requests:
+// true, false, wait_for, or "" to leave it to Elasticsearch
+func ConfiguredElasticSearchRefresh() string {
+	refresh := viper.GetString(key_es_refresh)
+	switch refresh {
+	case "", RefreshTrue, RefreshFalse, RefreshWaitFor:
+		return refresh
+	}
+	logs.Warn("Unknown Elasticsearch refresh %s; not refreshing", refresh)
+	return ""
+}
+
+// BulkPath is the path of bulk requests, with the default pipeline and
+// refresh parameters
+func BulkPath(pipeline string, refresh string) string {
+	params := url.Values{}
+	if pipeline != "" {
+		params.Set("pipeline", pipeline)
+	}
+	if refresh != "" {
+		params.Set("refresh", refresh)
+	}
+	if len(params) == 0 {
+		return "/_bulk"
+	}
+	return "/_bulk?" + params.Encode()
+}
+
+// routing is the routing of an event, or "" for the default
+func (w *ElasticSearchWorker) routing(obj map[string]interface{}) string {
+	if w.routingField == "" {
+		return ""
+	}
+	if v, found := obj[w.routingField]; found && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// pipeline is the ingest pipeline of an event, or "" for the default one
+func (w *ElasticSearchWorker) pipeline(obj map[string]interface{}) string {
+	if w.pipelineTemplate == nil || w.action == ActionUpdate {
+		return ""
+	}
+	pipeline, ok := w.pipelineTemplate.RenderFields(obj)
+	if !ok || pipeline == w.defaultPipeline {
+		return ""
+	}
+	return pipeline
+}
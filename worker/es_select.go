@@ -0,0 +1,181 @@
+package worker
+
+/*
+	es_select.go chooses the host each bulk request is sent to, from those
+	of es.hosts which are up, and may discover the hosts from the cluster.
+
+	es.host_selection is one of:
+
+		round_robin      each host in turn (the default)
+		random           a host at random
+		least_in_flight  the host with the fewest of the sink's requests
+		                 outstanding, so that a slow host is given less
+
+	The workers of a sink share their pool of hosts. With es.sniff set, one
+	of them asks the cluster for its HTTP nodes (GET /_nodes/http) on
+	startup, and again every es.sniff_interval seconds, and the workers send
+	to those instead of es.hosts. If sniffing fails, the hosts are left as
+	they were.
+*/
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const (
+	key_es_host_selection = "es.host_selection"
+	key_es_sniff          = "es.sniff"
+	key_es_sniff_interval = "es.sniff_interval"
+)
+
+// Host selection strategies
+const (
+	HostSelectionRoundRobin    = "round_robin"
+	HostSelectionRandom        = "random"
+	HostSelectionLeastInFlight = "least_in_flight"
+)
+
+// DefaultSniffInterval is the default time between sniffs of the cluster
+const DefaultSniffInterval = 5 * time.Minute
+
+// ConfiguredElasticSearchHostSelection is how a host is chosen for each request
+func ConfiguredElasticSearchHostSelection() string {
+	selection := viper.GetString(key_es_host_selection)
+	switch selection {
+	case "":
+		return HostSelectionRoundRobin
+	case HostSelectionRoundRobin, HostSelectionRandom, HostSelectionLeastInFlight:
+		return selection
+	}
+	logs.Warn("Unknown Elasticsearch host selection %s; using %s", selection, HostSelectionRoundRobin)
+	return HostSelectionRoundRobin
+}
+
+// ConfiguredElasticSearchSniff is whether to discover hosts from the cluster
+func ConfiguredElasticSearchSniff() bool {
+	return viper.GetBool(key_es_sniff)
+}
+
+// ConfiguredElasticSearchSniffInterval is the time between sniffs; zero
+// sniffs only on startup
+func ConfiguredElasticSearchSniffInterval() time.Duration {
+	if !viper.IsSet(key_es_sniff_interval) {
+		return DefaultSniffInterval
+	}
+	return time.Duration(viper.GetFloat64(key_es_sniff_interval) * float64(time.Second))
+}
+
+// NextHost picks a host which is not dead
+func (w *ElasticSearchWorker) NextHost() string {
+	hosts := w.hosts
+	if w.HostPool != nil {
+		hosts = w.HostPool.Live()
+	}
+	if len(hosts) == 0 {
+		return "localhost"
+	}
+	switch w.selection {
+	case HostSelectionRandom:
+		w.robinLock.Lock()
+		defer w.robinLock.Unlock()
+		if w.randInter == nil {
+			w.randInter = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		return hosts[w.randInter.Intn(len(hosts))]
+	case HostSelectionLeastInFlight:
+		if w.HostPool != nil {
+			return w.HostPool.LeastInFlight(w.nextRobin())
+		}
+	}
+	return hosts[w.nextRobin()%len(hosts)]
+}
+
+// nextRobin returns the round robin index, and moves it on
+func (w *ElasticSearchWorker) nextRobin() int {
+	w.robinLock.Lock()
+	defer w.robinLock.Unlock()
+	i := w.robinIndex
+	w.robinIndex++
+	if w.robinIndex < 0 {
+		w.robinIndex = 0
+	}
+	return i
+}
+
+// SniffAddress turns the publish_address of a node into a host. A node
+// with a host name publishes it as "name/ip:port"; the name is used, so
+// that it matches the cluster's certificate.
+func SniffAddress(publish string) string {
+	if i := strings.Index(publish, "/"); i >= 0 {
+		name, address := publish[:i], publish[i+1:]
+		if _, port, err := net.SplitHostPort(address); err == nil && name != "" {
+			return net.JoinHostPort(name, port)
+		}
+		return address
+	}
+	return publish
+}
+
+// sniff asks the cluster for its HTTP nodes, returning their hosts
+func (w *ElasticSearchWorker) sniff() []string {
+	for _, host := range w.HostPool.Live() {
+		status, body, err := w.request("GET", host, "/_nodes/http", nil)
+		if err != nil || status != 200 {
+			logs.Warn("Unable to sniff Elasticsearch nodes from %s: status %v, %v", host, status, err)
+			continue
+		}
+		var nodes struct {
+			Nodes map[string]struct {
+				HTTP struct {
+					PublishAddress string `json:"publish_address"`
+				} `json:"http"`
+			} `json:"nodes"`
+		}
+		if err = json.Unmarshal(body, &nodes); err != nil {
+			logs.Warn("Unable to read the nodes sniffed from %s: %v", host, err)
+			continue
+		}
+		var hosts []string
+		for _, node := range nodes.Nodes {
+			if node.HTTP.PublishAddress != "" {
+				hosts = append(hosts, SniffAddress(node.HTTP.PublishAddress))
+			}
+		}
+		sort.Strings(hosts)
+		return hosts
+	}
+	return nil
+}
+
+// Sniff replaces the hosts with the HTTP nodes of the cluster, if it can
+// find any
+func (w *ElasticSearchWorker) Sniff() {
+	hosts := w.sniff()
+	if len(hosts) == 0 {
+		logs.Warn("Sniffing found no Elasticsearch nodes; keeping %v", w.HostPool.Live())
+		return
+	}
+	logs.Debug("Sniffed Elasticsearch nodes %v", hosts)
+	w.HostPool.SetHosts(hosts)
+}
+
+// sniffEvery sniffs the cluster every interval, until quit is closed
+func (w *ElasticSearchWorker) sniffEvery(interval time.Duration, quit chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Sniff()
+		case <-quit:
+			return
+		}
+	}
+}
@@ -1,8 +1,18 @@
 package worker_test
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/willf/translog/worker"
@@ -223,3 +233,746 @@ func TestInit(t *testing.T) {
 		}
 	}
 }
+
+// sendOne sends an event through an Elasticsearch worker, and stops it
+func sendOne(t *testing.T) {
+	sendEvents(t, 1)
+}
+
+// sendEvents sends n events through an Elasticsearch worker, and stops it
+func sendEvents(t *testing.T, n int) {
+	w := &worker.ElasticSearchWorker{}
+	if err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	for i := 0; i < n; i++ {
+		work <- map[string]interface{}{"line": "hello", "i": i}
+	}
+	w.Stop()
+}
+
+func TestBulkRetriesWithBackoff(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.retry_backoff", 1)
+	sendOne(t)
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("expected 3 attempts, got %v", requests)
+	}
+}
+
+func TestBulkFailsOverToLiveHost(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(down.URL, "http://"), strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.retry_backoff", 1)
+	viper.Set("es.retries", 10)
+	sendOne(t)
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("expected the bulk request to reach the live host, got %v requests", requests)
+	}
+}
+
+func TestBulkGivesUpAfterRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.retry_backoff", 1)
+	viper.Set("es.retries", 2)
+	before := worker.DeadLetterCounts()[worker.ReasonRetriesExhausted]
+	sendOne(t)
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("expected 3 attempts, got %v", requests)
+	}
+	if worker.DeadLetterCounts()[worker.ReasonRetriesExhausted] != before+1 {
+		t.Errorf("expected the event to be dead-lettered, got %v", worker.DeadLetterCounts())
+	}
+}
+
+func TestBulkStopWithEveryRequestRetrying(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.max", 1)
+	viper.Set("es.max_in_flight", 1)
+	viper.Set("es.retry_backoff", 1)
+	viper.Set("es.retry_backoff_max", 10)
+	viper.Set("checkpoint.file", "/tmp/translog-test.checkpoint")
+	stopped := make(chan bool)
+	go func() {
+		sendEvents(t, 3)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the worker to stop while its only bulk request is retrying")
+	}
+}
+
+func TestBulkRetriesOnlyRejectedItems(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			rw.Write([]byte(`{"errors":true,"items":[{"create":{"_id":"a","status":201}},{"create":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}}]}`))
+			return
+		}
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"_id":"b","status":201}}]}`))
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.retry_backoff", 1)
+	sendEvents(t, 2)
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 bulk requests, got %v", len(bodies))
+	}
+	if lines := strings.Split(strings.TrimSpace(bodies[1]), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"i":1`) {
+		t.Errorf("expected only the rejected document to be retried, got %v", bodies[1])
+	}
+}
+
+func TestBulkDeadLettersFailedItems(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Write([]byte(`{"errors":true,"items":[{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [i]"}}}]}`))
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	before := worker.DeadLetterCounts()[worker.ReasonBulkItemFailed]
+	sendOne(t)
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("expected a rejected document not to be retried, got %v requests", requests)
+	}
+	if worker.DeadLetterCounts()[worker.ReasonBulkItemFailed] != before+1 {
+		t.Errorf("expected the document to be dead-lettered, got %v", worker.DeadLetterCounts())
+	}
+}
+
+func TestParseBulkResponse(t *testing.T) {
+	resp, err := worker.ParseBulkResponse([]byte(`{"took":3,"errors":true,"items":[{"index":{"_id":"x","status":200}},{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"bad"}}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, found := resp.Result(0); !found || !item.Succeeded() || item.ID != "x" {
+		t.Errorf("expected the first document to have succeeded, got %v", item)
+	}
+	if item, found := resp.Result(1); !found || item.Succeeded() || item.Retryable() || item.Err().Error() != "mapper_parsing_exception: bad" {
+		t.Errorf("expected the second document to have failed, got %v", item)
+	}
+}
+
+// bulkServer is a fake Elasticsearch of the given version which takes
+// every document, and keeps the bodies of the bulk requests
+type bulkServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	bodies  []string
+	queries []string
+}
+
+func newBulkServer(version string) *bulkServer {
+	b := &bulkServer{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			rw.Write([]byte(`{"version":{"number":"` + version + `"}}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		b.lock.Lock()
+		b.bodies = append(b.bodies, string(body))
+		b.queries = append(b.queries, r.URL.RawQuery)
+		b.lock.Unlock()
+		docs := strings.Count(string(body), "\n") / 2
+		items := strings.TrimSuffix(strings.Repeat(`{"create":{"status":201}},`, docs), ",")
+		rw.Write([]byte(`{"errors":false,"items":[` + items + `]}`))
+	}))
+	viper.Set("es.hosts", []string{strings.TrimPrefix(b.URL, "http://")})
+	return b
+}
+
+func (b *bulkServer) Bodies() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string{}, b.bodies...)
+}
+
+func (b *bulkServer) Queries() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string{}, b.queries...)
+}
+
+func TestBulkFlushInterval(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := newBulkServer("8.11.0")
+	defer server.Close()
+	viper.Set("es.flush_interval", 0.05)
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	defer w.Stop()
+	work <- map[string]interface{}{"line": "hello"}
+	for start := time.Now(); len(server.Bodies()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("expected a partial batch to be sent after the flush interval")
+		}
+	}
+}
+
+func TestBulkMaxBytes(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := newBulkServer("8.11.0")
+	defer server.Close()
+	viper.Set("es.max_bytes", 100)
+	sendEvents(t, 3)
+	bodies := server.Bodies()
+	if len(bodies) != 3 {
+		t.Errorf("expected a bulk request for each document, got %v", bodies)
+	}
+	for _, body := range bodies {
+		if len(body) > 100 {
+			t.Errorf("expected bodies of at most 100 bytes, got %v", len(body))
+		}
+	}
+}
+
+func TestUsesDocumentType(t *testing.T) {
+	versions := map[string]bool{"5.6.16": true, "6.8.0": true, "6": true, "7.17.0": false, "8": false, "opensearch 2.11.0": false, "": false}
+	for version, expected := range versions {
+		if worker.UsesDocumentType(version) != expected {
+			t.Errorf("expected UsesDocumentType(%q) to be %v", version, expected)
+		}
+	}
+}
+
+func TestBulkActionDetectsVersion(t *testing.T) {
+	for version, expected := range map[string]bool{"6.8.0": true, "8.11.0": false} {
+		viper.Reset()
+		server := newBulkServer(version)
+		sendOne(t)
+		server.Close()
+		bodies := server.Bodies()
+		if len(bodies) != 1 || strings.Contains(bodies[0], `"_type":"event"`) != expected {
+			t.Errorf("expected _type in the action for %v to be %v, got %v", version, expected, bodies)
+		}
+		if len(bodies) == 1 && !strings.HasPrefix(bodies[0], `{"create":{"_index":"analytics"`) {
+			t.Errorf("expected a create action, got %v", bodies[0])
+		}
+	}
+	viper.Reset()
+}
+
+func TestBulkVersionDetectedAfterOutage(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	var probes int32
+	var lock sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			if atomic.AddInt32(&probes, 1) == 1 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			rw.Write([]byte(`{"version":{"number":"6.8.0"}}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.retry_backoff", 1)
+	sendOne(t)
+	lock.Lock()
+	defer lock.Unlock()
+	if atomic.LoadInt32(&probes) != 2 {
+		t.Errorf("expected the version to be asked again after the cluster was down, got %v probes", probes)
+	}
+	if len(bodies) != 1 || !strings.Contains(bodies[0], `"_type":"event"`) {
+		t.Errorf("expected the action to have the _type Elasticsearch 6 needs, got %v", bodies)
+	}
+}
+
+func TestBulkUpdateAction(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := newBulkServer("8.11.0")
+	defer server.Close()
+	viper.Set("es.action", "update")
+	sendOne(t)
+	bodies := server.Bodies()
+	if len(bodies) != 1 || !strings.Contains(bodies[0], `{"update":`) || !strings.Contains(bodies[0], `{"doc":{`) {
+		t.Errorf("expected an update of the document, got %v", bodies)
+	}
+}
+
+func TestBulkDataStream(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := newBulkServer("8.11.0")
+	defer server.Close()
+	viper.Set("es.data_stream", true)
+	viper.Set("es.action", "index")
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	before := worker.DeadLetterCounts()[worker.ReasonMissingTimestamp]
+	work <- map[string]interface{}{"line": "no timestamp"}
+	work <- map[string]interface{}{"line": "hello", "@timestamp": "2016-04-01T11:00:00Z"}
+	w.Stop()
+	if worker.DeadLetterCounts()[worker.ReasonMissingTimestamp] != before+1 {
+		t.Errorf("expected the event without a timestamp to be dead-lettered, got %v", worker.DeadLetterCounts())
+	}
+	bodies := server.Bodies()
+	if len(bodies) != 1 || !strings.HasPrefix(bodies[0], `{"create":`) || strings.Count(bodies[0], "\n") != 2 {
+		t.Errorf("expected the event with a timestamp to be created, got %v", bodies)
+	}
+}
+
+func TestHashDocumentID(t *testing.T) {
+	fields := []string{"ip", "created"}
+	first := worker.HashDocumentID(map[string]interface{}{"ip": "8.8.8.8", "created": "2016-04-01", "age": 47}, fields)
+	second := worker.HashDocumentID(map[string]interface{}{"ip": "8.8.8.8", "created": "2016-04-01", "age": 48}, fields)
+	third := worker.HashDocumentID(map[string]interface{}{"ip": "8.8.4.4", "created": "2016-04-01", "age": 47}, fields)
+	if first != second {
+		t.Errorf("expected fields which are not hashed to leave the _id alone, got %v and %v", first, second)
+	}
+	if first == third {
+		t.Errorf("expected different fields to hash to different _ids, got %v", first)
+	}
+}
+
+func TestBulkDocumentID(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := newBulkServer("8.11.0")
+	defer server.Close()
+	viper.Set("es.id_field", "line")
+	sendOne(t)
+	bodies := server.Bodies()
+	if len(bodies) != 1 || !strings.HasPrefix(bodies[0], `{"create":{"_index":"analytics","_id":"hello"}}`) {
+		t.Errorf("expected the _id to be taken from the line field, got %v", bodies)
+	}
+}
+
+func TestBulkConflictIsNotAFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"errors":true,"items":[{"create":{"_id":"x","status":409,"error":{"type":"version_conflict_engine_exception","reason":"document already exists"}}}]}`))
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.id_hash_fields", []string{"@source", "@offset"})
+	before := worker.DeadLetterCounts()[worker.ReasonBulkItemFailed]
+	sendOne(t)
+	if worker.DeadLetterCounts()[worker.ReasonBulkItemFailed] != before {
+		t.Errorf("expected a document created by an earlier request not to be dead-lettered, got %v", worker.DeadLetterCounts())
+	}
+}
+
+func TestBulkGzipCompression(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(reader)
+		received = string(body)
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}},{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.compression", "gzip")
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	line := strings.Repeat("a repetitive line compresses well ", 20)
+	work <- map[string]interface{}{"line": line}
+	work <- map[string]interface{}{"line": line}
+	w.Stop()
+	if strings.Count(received, line) != 2 {
+		t.Errorf("expected the bulk body to round-trip through gzip, got %q", received)
+	}
+	if w.BytesUncompressed() != int64(len(received)) || w.BytesSent() >= w.BytesUncompressed() {
+		t.Errorf("expected %v bytes compressed to fewer, got %v compressed to %v", len(received), w.BytesUncompressed(), w.BytesSent())
+	}
+}
+
+func TestBulkPath(t *testing.T) {
+	if path := worker.BulkPath("", ""); path != "/_bulk" {
+		t.Errorf("expected /_bulk, got %v", path)
+	}
+	if path := worker.BulkPath("geoip", "wait_for"); path != "/_bulk?pipeline=geoip&refresh=wait_for" {
+		t.Errorf("expected the pipeline and refresh parameters, got %v", path)
+	}
+}
+
+func TestBulkPipelineAndRouting(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := newBulkServer("8.11.0")
+	defer server.Close()
+	viper.Set("es.pipeline", "default-logs")
+	viper.Set("es.refresh", "wait_for")
+	viper.Set("es.pipeline_template", "{service}-Logs")
+	viper.Set("es.routing_field", "customer")
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	work <- map[string]interface{}{"line": "hello", "service": "nginx", "customer": 42}
+	work <- map[string]interface{}{"line": "no service"}
+	w.Stop()
+	if queries := server.Queries(); len(queries) != 1 || queries[0] != "pipeline=default-logs&refresh=wait_for" {
+		t.Errorf("expected the default pipeline and refresh on the bulk request, got %v", queries)
+	}
+	bodies := server.Bodies()
+	if len(bodies) != 1 {
+		t.Fatalf("expected one bulk request, got %v", bodies)
+	}
+	lines := strings.Split(bodies[0], "\n")
+	if lines[0] != `{"create":{"_index":"analytics","routing":"42","pipeline":"nginx-Logs"}}` {
+		t.Errorf("expected the event's routing and pipeline, got %v", lines[0])
+	}
+	if lines[2] != `{"create":{"_index":"analytics"}}` {
+		t.Errorf("expected an event without the fields to use the defaults, got %v", lines[2])
+	}
+}
+
+func TestNextHostRoundRobin(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{"alpha", "beta", "gamma"})
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		counts[w.NextHost()]++
+	}
+	if counts["alpha"] != 10 || counts["beta"] != 10 || counts["gamma"] != 10 {
+		t.Errorf("expected the hosts to be used in turn, got %v", counts)
+	}
+}
+
+func TestNextHostRandom(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{"alpha", "beta"})
+	viper.Set("es.host_selection", "random")
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		counts[w.NextHost()]++
+	}
+	if counts["alpha"] == 0 || counts["beta"] == 0 || counts["alpha"]+counts["beta"] != 200 {
+		t.Errorf("expected both hosts to be picked, got %v", counts)
+	}
+}
+
+func TestSniffAddress(t *testing.T) {
+	for publish, expected := range map[string]string{
+		"10.0.0.1:9200":                 "10.0.0.1:9200",
+		"es1.example.com/10.0.0.1:9200": "es1.example.com:9200",
+		"/10.0.0.1:9200":                "10.0.0.1:9200",
+		"[::1]:9200":                    "[::1]:9200",
+	} {
+		if host := worker.SniffAddress(publish); host != expected {
+			t.Errorf("expected %v for %v, got %v", expected, publish, host)
+		}
+	}
+}
+
+func TestBulkSniff(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	var bulks int32
+	node := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_bulk" {
+			atomic.AddInt32(&bulks, 1)
+			rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+		}
+	}))
+	defer node.Close()
+	seed := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_nodes/http" {
+			address := strings.TrimPrefix(node.URL, "http://")
+			rw.Write([]byte(`{"nodes":{"a1":{"http":{"publish_address":"` + address + `"}}}}`))
+			return
+		}
+		t.Errorf("expected only sniffing on the seed host, got %v", r.URL.Path)
+	}))
+	defer seed.Close()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(seed.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.sniff", true)
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	work <- map[string]interface{}{"line": "hello"}
+	w.Stop()
+	if host := w.NextHost(); host != strings.TrimPrefix(node.URL, "http://") {
+		t.Errorf("expected the sniffed node to be used, got %v", host)
+	}
+	if atomic.LoadInt32(&bulks) != 1 {
+		t.Errorf("expected the event to be sent to the sniffed node, got %v bulk requests", bulks)
+	}
+}
+
+func TestBulkOutageWithSpool(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var up int32
+	var documents int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		docs := strings.Count(string(body), "\n") / 2
+		atomic.AddInt32(&documents, int32(docs))
+		items := strings.TrimSuffix(strings.Repeat(`{"create":{"status":201}},`, docs), ",")
+		rw.Write([]byte(`{"errors":false,"items":[` + items + `]}`))
+	}))
+	defer server.Close()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.retries", 1)
+	viper.Set("es.retry_backoff", 1)
+	viper.Set("es.retry_backoff_max", 10)
+	viper.Set("es.flush_interval", 0.01)
+	viper.Set("spool.dir", dir)
+	spool := worker.ConfiguredSpool()
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	w.SetWorkChannel(spool.Channel())
+	w.Start()
+	in := make(chan map[string]interface{})
+	spool.Start(in)
+	before := worker.DeadLetterCounts()
+	for i := 0; i < 3; i++ {
+		in <- map[string]interface{}{"line": fmt.Sprint("event ", i)}
+	}
+	// far longer than the retries take
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt32(&documents) != 0 {
+		t.Fatalf("expected nothing to be delivered while Elasticsearch is down")
+	}
+	atomic.StoreInt32(&up, 1)
+	for start := time.Now(); atomic.LoadInt32(&documents) < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("expected the events to be delivered once Elasticsearch is back, got %v", atomic.LoadInt32(&documents))
+		}
+	}
+	w.Stop()
+	spool.Stop()
+	after := worker.DeadLetterCounts()
+	if after[worker.ReasonRetriesExhausted] != before[worker.ReasonRetriesExhausted] {
+		t.Errorf("expected no events to be dead-lettered during the outage, got %v", after)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.spool")); len(files) != 0 {
+		t.Errorf("expected the delivered spool segment to be removed, got %v", files)
+	}
+}
+
+func TestBulkStopDuringOutage(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.retry_backoff", 1)
+	viper.Set("es.retry_backoff_max", 10)
+	viper.Set("checkpoint.file", "/tmp/translog-test.checkpoint")
+	before := worker.DeadLetterCounts()
+	stopped := make(chan bool)
+	go func() {
+		sendOne(t)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the worker to stop while Elasticsearch is down")
+	}
+	if after := worker.DeadLetterCounts(); after[worker.ReasonRetriesExhausted] != before[worker.ReasonRetriesExhausted] {
+		t.Errorf("expected the undelivered event to be left to be read again, got %v", after)
+	}
+}
+
+func TestBulkUnreadableResponseIsRetried(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			rw.Write([]byte(`<html><body>Welcome to our proxy</body></html>`))
+			return
+		}
+		if atomic.LoadInt32(&requests) == 2 {
+			rw.Write([]byte(`{"errors":false,"items":[]}`))
+			return
+		}
+		rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("es.hosts", []string{strings.TrimPrefix(server.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.retry_backoff", 1)
+	sendOne(t)
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("expected responses which are not bulk results to be retried, got %v requests", requests)
+	}
+}
+
+func TestBulkDataStreamTimestampFromParsedTime(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	server := newBulkServer("8.11.0")
+	defer server.Close()
+	viper.Set("es.data_stream", true)
+	viper.Set("parse.pattern", `(?P<created>\S+) (?P<message>.*)`)
+	parser := &worker.LogParser{}
+	parser.Init()
+	obj, err := parser.ParseEvents("2016-04-01T11:00:00Z hello")
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	w := &worker.ElasticSearchWorker{}
+	w.Init()
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	work <- obj
+	w.Stop()
+	bodies := server.Bodies()
+	if len(bodies) != 1 || !strings.Contains(bodies[0], `"@timestamp":"2016-04-01T11:00:00Z"`) {
+		t.Errorf("expected the parsed time to be the @timestamp, got %v", bodies)
+	}
+	if _, found := obj["@timestamp"]; found {
+		t.Errorf("expected the event itself to be left alone")
+	}
+}
+
+func TestSharedHostPool(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	var sniffs int32
+	seed := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_nodes/http" {
+			atomic.AddInt32(&sniffs, 1)
+		}
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer seed.Close()
+	viper.Set("es.hosts", []string{"alpha", "beta"})
+	viper.Set("es.host_selection", "least_in_flight")
+	pool := worker.NewEsHostPool(nil)
+	first := &worker.ElasticSearchWorker{HostPool: pool}
+	second := &worker.ElasticSearchWorker{HostPool: pool, WorkerNumber: 1}
+	first.Init()
+	second.Init()
+	busy := first.NextHost()
+	pool.Begin(busy)
+	for i := 0; i < 4; i++ {
+		if host := second.NextHost(); host == busy {
+			t.Errorf("expected the other worker's request to %v to be counted, got %v", busy, host)
+		}
+	}
+
+	viper.Set("es.hosts", []string{strings.TrimPrefix(seed.URL, "http://")})
+	viper.Set("es.version", "8")
+	viper.Set("es.sniff", true)
+	pool = worker.NewEsHostPool(nil)
+	workers := []*worker.ElasticSearchWorker{{HostPool: pool}, {HostPool: pool, WorkerNumber: 1}}
+	for _, w := range workers {
+		w.Init()
+		w.SetWorkChannel(make(chan map[string]interface{}))
+		w.Start()
+	}
+	for _, w := range workers {
+		w.Stop()
+	}
+	if atomic.LoadInt32(&sniffs) != 1 {
+		t.Errorf("expected the cluster to be sniffed once for the sink, got %v", sniffs)
+	}
+}
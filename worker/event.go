@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// MetadataKey is the key under which an event carries its EventMetadata.
+// It is never written out by the sinks.
+const MetadataKey = "@metadata"
+
+// EventMetadata describes where an event was read from
+type EventMetadata struct {
+	Source string // path of the input file
+	Offset int64  // byte offset just past the event in the input file
+	Raw    string // the line(s) the event was parsed from
+	ack    func()
+	shares int32
+}
+
+// Metadata returns the metadata of the event, or nil if it has none
+func Metadata(obj map[string]interface{}) *EventMetadata {
+	meta, _ := obj[MetadataKey].(*EventMetadata)
+	return meta
+}
+
+// SetAck sets the function called once the event has been delivered, for
+// inputs other than the LogParser
+func SetAck(obj map[string]interface{}, ack func()) {
+	meta := Metadata(obj)
+	if meta == nil {
+		meta = &EventMetadata{}
+		obj[MetadataKey] = meta
+	}
+	meta.ack = ack
+}
+
+// ShareEvent records that the event is sent to n sinks, each of which
+// will Ack it
+func ShareEvent(obj map[string]interface{}, n int) {
+	if meta := Metadata(obj); meta != nil {
+		atomic.StoreInt32(&meta.shares, int32(n))
+	}
+}
+
+// Ack tells the event's input that a sink has delivered it, so that its
+// position may be checkpointed once every sink it was shared with has
+func Ack(obj map[string]interface{}) {
+	meta := Metadata(obj)
+	if meta == nil || atomic.AddInt32(&meta.shares, -1) > 0 {
+		return
+	}
+	if meta.ack != nil {
+		meta.ack()
+	}
+}
+
+// EventFields returns the fields of the event, leaving out its metadata
+func EventFields(obj map[string]interface{}) map[string]interface{} {
+	if _, found := obj[MetadataKey]; !found {
+		return obj
+	}
+	out := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if k != MetadataKey {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// MarshalEvent marshals the event to JSON, leaving out its metadata
+func MarshalEvent(obj map[string]interface{}) ([]byte, error) {
+	return json.Marshal(EventFields(obj))
+}
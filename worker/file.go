@@ -1,7 +1,6 @@
 package worker
 
 import (
-	"encoding/json"
 	"os"
 	"time"
 
@@ -67,14 +66,17 @@ func (w *FileWorker) Work() {
 		select {
 		case obj := <-w.WorkChannel:
 			logs.Debug("Worker received: %v", obj)
-			line, err := json.Marshal(obj)
+			line, err := MarshalEvent(obj)
 			if err != nil {
 				logs.Info("Unable to marshal object %v", obj)
+				DeadLetterEvent(obj, ReasonMarshalFailed, err)
+				Ack(obj)
 				break
 			}
 			out := w.CachedFileHandle()
 			out.WriteString(string(line))
 			out.WriteString("\n")
+			Ack(obj)
 
 		case <-w.QuitChannel:
 			logs.Info("Worker received quit")
@@ -0,0 +1,456 @@
+package worker
+
+/*
+	ga.go sends events to Google Analytics as Measurement Protocol hits.
+
+	Each event becomes a page view or an event hit (ga.hit_type, or the
+	value of the field named by ga.hit_type_field), for the property
+	ga.tid (or the value of ga.tid_field). Its client id is the value of
+	ga.cid_field, or, failing that, a hash of the ga.cid_hash_fields, so
+	that the hits of one visitor are counted together. ga.fields maps
+	Measurement Protocol parameters to the event fields holding their
+	values; the event's time, from ga.timestamp_field, is sent as the
+	queue time.
+
+	Hits are sent in batches of up to 20 to ga.endpoint, which may be
+	pointed at a local collector for testing. A batch which fails is
+	retried with backoff, and then dead-lettered; so is a hit with too
+	little to go on, and one queued for longer than Google Analytics
+	accepts (which it would drop without saying so).
+*/
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configGAEndpoint = "ga.endpoint"
+const configGATid = "ga.tid"
+const configGATidField = "ga.tid_field"
+const configGACidField = "ga.cid_field"
+const configGACidHashFields = "ga.cid_hash_fields"
+const configGAHitType = "ga.hit_type"
+const configGAHitTypeField = "ga.hit_type_field"
+const configGAFields = "ga.fields"
+const configGATimestampField = "ga.timestamp_field"
+const configGAMax = "ga.max"
+const configGAFlushInterval = "ga.flush_interval"
+const configGARetries = "ga.retries"
+const configGARetryBackoff = "ga.retry_backoff"
+const configGATimeout = "ga.timeout"
+
+// DefaultGAEndpoint is the batch endpoint of the Measurement Protocol
+const DefaultGAEndpoint = "https://www.google-analytics.com/batch"
+
+// Limits of the Measurement Protocol on a batch request
+const (
+	GAMaxHits      = 20
+	GAMaxHitBytes  = 8 * 1024
+	GAMaxBatchSize = 16 * 1024
+)
+
+// GAMaxQueueTime is the longest a hit may be queued; Google Analytics drops
+// older ones
+const GAMaxQueueTime = 4 * time.Hour
+
+// GA hit types
+const (
+	GAHitPageview = "pageview"
+	GAHitEvent    = "event"
+)
+
+// ReasonInvalidHit is the dead-letter reason for events which cannot be
+// made into a Measurement Protocol hit
+const ReasonInvalidHit = "invalid_hit"
+
+// ReasonHitTooOld is the dead-letter reason for events queued for longer
+// than GAMaxQueueTime
+const ReasonHitTooOld = "hit_too_old"
+
+// DefaultGAFields maps Measurement Protocol parameters to the fields the
+// presets give web server logs: the page, the visitor's IP and user agent,
+// and the referrer; and the parameters of event hits to fields of the same
+// name.
+var DefaultGAFields = map[string]string{
+	"dp":  "uri",
+	"uip": "client",
+	"ua":  "user_agent",
+	"dr":  "referer",
+	"ec":  "category",
+	"ea":  "action",
+	"el":  "label",
+	"ev":  "value",
+}
+
+// DefaultGACidHashFields are the fields hashed into a client id
+var DefaultGACidHashFields = []string{"client", "user_agent"}
+
+// GoogleAnalyticsWorker sends events to Google Analytics
+type GoogleAnalyticsWorker struct {
+	WorkChannel    chan map[string]interface{}
+	QuitChannel    chan bool
+	startTime      time.Time
+	client         *http.Client
+	endpoint       string
+	tid            string
+	tidField       string
+	cidField       string
+	cidHashFields  []string
+	hitType        string
+	hitTypeField   string
+	fields         map[string]string
+	timestampField string
+	max            int
+	retries        int
+	backoff        time.Duration
+	flushInterval  time.Duration
+	flushTimer     <-chan time.Time
+	hits           []string
+	events         []map[string]interface{}
+	bytes          int
+}
+
+// ConfiguredGAEndpoint is the URL hits are sent to
+func ConfiguredGAEndpoint() string {
+	if viper.IsSet(configGAEndpoint) {
+		return viper.GetString(configGAEndpoint)
+	}
+	return DefaultGAEndpoint
+}
+
+// ConfiguredGATid is the tracking id of the property hits are sent to
+func ConfiguredGATid() string {
+	return viper.GetString(configGATid)
+}
+
+// ConfiguredGATidField is the event field holding the tracking id, if any
+func ConfiguredGATidField() string {
+	return viper.GetString(configGATidField)
+}
+
+// ConfiguredGACidField is the event field holding the client id, if any
+func ConfiguredGACidField() string {
+	return viper.GetString(configGACidField)
+}
+
+// ConfiguredGACidHashFields are the fields hashed into a client id
+func ConfiguredGACidHashFields() []string {
+	if viper.IsSet(configGACidHashFields) {
+		return viper.GetStringSlice(configGACidHashFields)
+	}
+	return DefaultGACidHashFields
+}
+
+// ConfiguredGAHitType is the type of hit: pageview or event
+func ConfiguredGAHitType() string {
+	hitType := viper.GetString(configGAHitType)
+	switch hitType {
+	case "":
+		return GAHitPageview
+	case GAHitPageview, GAHitEvent:
+		return hitType
+	}
+	logs.Warn("Unknown Google Analytics hit type %s; using %s", hitType, GAHitPageview)
+	return GAHitPageview
+}
+
+// ConfiguredGAHitTypeField is the event field holding the type of hit, if any
+func ConfiguredGAHitTypeField() string {
+	return viper.GetString(configGAHitTypeField)
+}
+
+// ConfiguredGAFields maps Measurement Protocol parameters to event fields.
+// ga.fields is laid over DefaultGAFields; map a parameter to "" to leave
+// it out.
+func ConfiguredGAFields() map[string]string {
+	fields := make(map[string]string, len(DefaultGAFields))
+	for param, field := range DefaultGAFields {
+		fields[param] = field
+	}
+	for param, field := range viper.GetStringMapString(configGAFields) {
+		if field == "" {
+			delete(fields, param)
+		} else {
+			fields[param] = field
+		}
+	}
+	return fields
+}
+
+// ConfiguredGATimestampField is the field holding the event's time
+func ConfiguredGATimestampField() string {
+	if viper.IsSet(configGATimestampField) {
+		return viper.GetString(configGATimestampField)
+	}
+	return DefaultTimestampField
+}
+
+// ConfiguredGAMax is the most hits sent in one request
+func ConfiguredGAMax() int {
+	if max := viper.GetInt(configGAMax); max > 0 && max < GAMaxHits {
+		return max
+	}
+	return GAMaxHits
+}
+
+// ConfiguredGAFlushInterval is how long a partial batch may wait
+func ConfiguredGAFlushInterval() time.Duration {
+	if !viper.IsSet(configGAFlushInterval) {
+		return 5 * time.Second
+	}
+	return time.Duration(viper.GetFloat64(configGAFlushInterval) * float64(time.Second))
+}
+
+// ConfiguredGARetries is how many times a failed request is retried
+func ConfiguredGARetries() int {
+	if viper.IsSet(configGARetries) {
+		return viper.GetInt(configGARetries)
+	}
+	return 3
+}
+
+// ConfiguredGARetryBackoff is the wait before the first retry
+func ConfiguredGARetryBackoff() time.Duration {
+	if viper.IsSet(configGARetryBackoff) {
+		return time.Duration(viper.GetInt(configGARetryBackoff)) * time.Millisecond
+	}
+	return 100 * time.Millisecond
+}
+
+// ConfiguredGATimeout is how long a request may take
+func ConfiguredGATimeout() time.Duration {
+	if viper.IsSet(configGATimeout) {
+		return time.Duration(viper.GetInt(configGATimeout)) * time.Second
+	}
+	return 60 * time.Second
+}
+
+func (w *GoogleAnalyticsWorker) SetWorkChannel(channel chan map[string]interface{}) {
+	w.WorkChannel = channel
+}
+
+func (w *GoogleAnalyticsWorker) Init() (err error) {
+	w.QuitChannel = make(chan bool)
+	w.endpoint = ConfiguredGAEndpoint()
+	if _, err = url.Parse(w.endpoint); err != nil {
+		logs.Fatal("Invalid Google Analytics endpoint: %v", w.endpoint)
+		return
+	}
+	w.tid = ConfiguredGATid()
+	w.tidField = ConfiguredGATidField()
+	if w.tid == "" && w.tidField == "" {
+		err = fmt.Errorf("No Google Analytics tracking id; set %s", configGATid)
+		logs.Fatal("%v", err)
+		return
+	}
+	w.cidField = ConfiguredGACidField()
+	w.cidHashFields = ConfiguredGACidHashFields()
+	w.hitType = ConfiguredGAHitType()
+	w.hitTypeField = ConfiguredGAHitTypeField()
+	w.fields = ConfiguredGAFields()
+	w.timestampField = ConfiguredGATimestampField()
+	w.max = ConfiguredGAMax()
+	w.retries = ConfiguredGARetries()
+	w.backoff = ConfiguredGARetryBackoff()
+	w.flushInterval = ConfiguredGAFlushInterval()
+	w.client = &http.Client{Timeout: ConfiguredGATimeout()}
+	w.reset()
+	return
+}
+
+// reset clears out the batch
+func (w *GoogleAnalyticsWorker) reset() {
+	w.hits = make([]string, 0, w.max)
+	w.events = make([]map[string]interface{}, 0, w.max)
+	w.bytes = 0
+	w.flushTimer = nil
+}
+
+// Start the work
+func (w *GoogleAnalyticsWorker) Start() {
+	logs.Debug("Worker is %v", w)
+	go w.Work()
+}
+
+// Work the queue
+func (w *GoogleAnalyticsWorker) Work() {
+	w.startTime = time.Now()
+	logs.Info("GoogleAnalyticsWorker starting work at %v", w.startTime)
+	for {
+		select {
+		case obj := <-w.WorkChannel:
+			logs.Debug("Worker received: %v", obj)
+			if queued := w.queueTime(obj); queued > GAMaxQueueTime {
+				DeadLetterEvent(obj, ReasonHitTooOld, fmt.Errorf("queued for %v, longer than the %v Google Analytics accepts", queued, GAMaxQueueTime))
+				Ack(obj)
+				break
+			}
+			hit, err := w.Hit(obj)
+			if err != nil {
+				DeadLetterEvent(obj, ReasonInvalidHit, err)
+				Ack(obj)
+				break
+			}
+			if len(w.hits) >= w.max || w.bytes+len(hit)+1 > GAMaxBatchSize {
+				w.flush()
+			}
+			if len(w.hits) == 0 && w.flushInterval > 0 {
+				w.flushTimer = time.After(w.flushInterval)
+			}
+			w.hits = append(w.hits, hit)
+			w.events = append(w.events, obj)
+			w.bytes += len(hit) + 1
+
+		case <-w.flushTimer:
+			w.flush()
+
+		case <-w.QuitChannel:
+			logs.Info("Google Analytics worker received quit")
+			return
+		}
+	}
+}
+
+// Stop stops the worker by send a message on its quit channel, and sends
+// the hits it holds
+func (w *GoogleAnalyticsWorker) Stop() {
+	w.QuitChannel <- true
+	w.flush()
+}
+
+// Hit renders an event as the payload of a Measurement Protocol hit
+func (w *GoogleAnalyticsWorker) Hit(obj map[string]interface{}) (string, error) {
+	hit := url.Values{}
+	hit.Set("v", "1")
+	tid := w.tid
+	if v := w.field(obj, w.tidField); v != "" {
+		tid = v
+	}
+	if tid == "" {
+		return "", fmt.Errorf("no tracking id in %s", w.tidField)
+	}
+	hit.Set("tid", tid)
+	cid := w.field(obj, w.cidField)
+	if cid == "" {
+		cid = hashClientID(obj, w.cidHashFields)
+	}
+	hit.Set("cid", cid)
+	hitType := w.hitType
+	if v := w.field(obj, w.hitTypeField); v == GAHitPageview || v == GAHitEvent {
+		hitType = v
+	}
+	hit.Set("t", hitType)
+	for param, field := range w.fields {
+		if v := w.field(obj, field); v != "" {
+			hit.Set(param, v)
+		}
+	}
+	if queued := w.queueTime(obj); queued > GAMaxQueueTime {
+		return "", fmt.Errorf("queued for %v, longer than the %v Google Analytics accepts", queued, GAMaxQueueTime)
+	} else if queued > 0 {
+		hit.Set("qt", fmt.Sprint(int64(queued/time.Millisecond)))
+	}
+	switch {
+	case hitType == GAHitPageview && hit.Get("dp") == "" && hit.Get("dl") == "":
+		return "", fmt.Errorf("a pageview needs a page (dp or dl)")
+	case hitType == GAHitEvent && (hit.Get("ec") == "" || hit.Get("ea") == ""):
+		return "", fmt.Errorf("an event needs a category (ec) and an action (ea)")
+	}
+	payload := hit.Encode()
+	if len(payload) > GAMaxHitBytes {
+		return "", fmt.Errorf("hit of %v bytes is over the limit of %v", len(payload), GAMaxHitBytes)
+	}
+	return payload, nil
+}
+
+// queueTime is how long ago the event happened, by its time from
+// ga.timestamp_field, or zero if it has none
+func (w *GoogleAnalyticsWorker) queueTime(obj map[string]interface{}) time.Duration {
+	if when, ok := EventTime(obj[w.timestampField]); ok {
+		return time.Since(when)
+	}
+	return 0
+}
+
+// field is the value of an event's field as a string, or ""
+func (w *GoogleAnalyticsWorker) field(obj map[string]interface{}, field string) string {
+	if field == "" {
+		return ""
+	}
+	if v, found := obj[field]; found && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// hashClientID hashes the fields of an event into a client id, formatted
+// like a UUID
+func hashClientID(obj map[string]interface{}, fields []string) string {
+	h := HashDocumentID(obj, fields)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// flush sends the batch, retrying with backoff when it fails
+func (w *GoogleAnalyticsWorker) flush() {
+	if len(w.hits) == 0 {
+		return
+	}
+	hits, events := w.hits, w.events
+	w.reset()
+	body := strings.Join(hits, "\n")
+	var err error
+	for attempt := 0; ; attempt++ {
+		var status int
+		var respBody []byte
+		status, respBody, err = w.post([]byte(body))
+		switch {
+		case err != nil:
+			logs.Warn("POST of %v hits to Google Analytics failed: %v", len(hits), err)
+		case status >= 200 && status <= 299:
+			logs.Debug("Sent %v hits to Google Analytics", len(hits))
+			for _, obj := range events {
+				Ack(obj)
+			}
+			return
+		case status == http.StatusTooManyRequests || status >= 500:
+			logs.Warn("POST of %v hits to Google Analytics failed with status %v: %s", len(hits), status, respBody)
+			err = fmt.Errorf("status %v: %s", status, respBody)
+		default:
+			logs.Warn("Google Analytics rejected %v hits with status %v: %s", len(hits), status, respBody)
+			w.deadLetter(events, ReasonRejected, fmt.Errorf("status %v: %s", status, respBody))
+			return
+		}
+		if w.retries >= 0 && attempt >= w.retries {
+			logs.Warn("Giving up on %v hits to Google Analytics after %v attempts", len(hits), attempt+1)
+			w.deadLetter(events, ReasonRetriesExhausted, err)
+			return
+		}
+		time.Sleep(backoffDelay(w.backoff, 30*time.Second, attempt))
+	}
+}
+
+// post sends a batch of hits, returning the status and the body of the response
+func (w *GoogleAnalyticsWorker) post(body []byte) (status int, respBody []byte, err error) {
+	resp, err := w.client.Post(w.endpoint, "text/plain", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+// deadLetter dead-letters and acknowledges the events of a failed batch
+func (w *GoogleAnalyticsWorker) deadLetter(events []map[string]interface{}, reason string, err error) {
+	for _, obj := range events {
+		DeadLetterEvent(obj, reason, err)
+		Ack(obj)
+	}
+}
@@ -0,0 +1,171 @@
+package worker_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+// gaCollector is a fake Measurement Protocol collector
+type gaCollector struct {
+	*httptest.Server
+	lock    sync.Mutex
+	batches [][]url.Values
+	status  int
+}
+
+func newGACollector(status int) *gaCollector {
+	c := &gaCollector{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var hits []url.Values
+		for _, line := range strings.Split(string(body), "\n") {
+			hit, _ := url.ParseQuery(line)
+			hits = append(hits, hit)
+		}
+		c.lock.Lock()
+		c.batches = append(c.batches, hits)
+		c.lock.Unlock()
+		rw.WriteHeader(c.status)
+	}))
+	viper.Set("ga.endpoint", c.URL+"/batch")
+	viper.Set("ga.tid", "UA-1234-1")
+	return c
+}
+
+func (c *gaCollector) Batches() [][]url.Values {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([][]url.Values{}, c.batches...)
+}
+
+func sendGA(t *testing.T, events ...map[string]interface{}) {
+	w := &worker.GoogleAnalyticsWorker{}
+	if err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	work := make(chan map[string]interface{})
+	w.SetWorkChannel(work)
+	w.Start()
+	for _, obj := range events {
+		work <- obj
+	}
+	w.Stop()
+}
+
+func TestGAPageview(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	collector := newGACollector(http.StatusOK)
+	defer collector.Close()
+	sendGA(t, map[string]interface{}{"uri": "/index.html", "client": "8.8.8.8", "user_agent": "curl/7.0"})
+	batches := collector.Batches()
+	if len(batches) != 1 || len(batches[0]) != 1 {
+		t.Fatalf("expected one batch of one hit, got %v", batches)
+	}
+	hit := batches[0][0]
+	for param, expected := range map[string]string{"v": "1", "tid": "UA-1234-1", "t": "pageview", "dp": "/index.html", "uip": "8.8.8.8", "ua": "curl/7.0"} {
+		if hit.Get(param) != expected {
+			t.Errorf("expected %v to be %v, got %v", param, expected, hit.Get(param))
+		}
+	}
+	if len(hit.Get("cid")) != 36 {
+		t.Errorf("expected a client id hashed from the client and user agent, got %v", hit.Get("cid"))
+	}
+}
+
+func TestGAEventMappings(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	collector := newGACollector(http.StatusOK)
+	defer collector.Close()
+	viper.Set("ga.hit_type", "event")
+	viper.Set("ga.tid_field", "property")
+	viper.Set("ga.cid_field", "visitor")
+	viper.Set("ga.fields", map[string]string{"ec": "kind", "ea": "verb", "uip": ""})
+	sendGA(t, map[string]interface{}{"property": "UA-9-9", "visitor": "v1", "kind": "video", "verb": "play", "client": "8.8.8.8"})
+	batches := collector.Batches()
+	if len(batches) != 1 || len(batches[0]) != 1 {
+		t.Fatalf("expected one batch of one hit, got %v", batches)
+	}
+	hit := batches[0][0]
+	for param, expected := range map[string]string{"tid": "UA-9-9", "cid": "v1", "t": "event", "ec": "video", "ea": "play", "uip": ""} {
+		if hit.Get(param) != expected {
+			t.Errorf("expected %v to be %v, got %v", param, expected, hit.Get(param))
+		}
+	}
+}
+
+func TestGABatches(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	collector := newGACollector(http.StatusOK)
+	defer collector.Close()
+	var events []map[string]interface{}
+	for i := 0; i < 45; i++ {
+		events = append(events, map[string]interface{}{"uri": "/"})
+	}
+	sendGA(t, events...)
+	batches := collector.Batches()
+	if len(batches) != 3 || len(batches[0]) != 20 || len(batches[1]) != 20 || len(batches[2]) != 5 {
+		t.Errorf("expected batches of at most 20 hits, got %v batches", len(batches))
+	}
+}
+
+func TestGAInvalidHit(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	collector := newGACollector(http.StatusOK)
+	defer collector.Close()
+	before := worker.DeadLetterCounts()[worker.ReasonInvalidHit]
+	sendGA(t, map[string]interface{}{"line": "no page"})
+	if worker.DeadLetterCounts()[worker.ReasonInvalidHit] != before+1 {
+		t.Errorf("expected a pageview without a page to be dead-lettered, got %v", worker.DeadLetterCounts())
+	}
+	if len(collector.Batches()) != 0 {
+		t.Errorf("expected nothing to be sent, got %v", collector.Batches())
+	}
+}
+
+func TestGAHitTooOld(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	collector := newGACollector(http.StatusOK)
+	defer collector.Close()
+	before := worker.DeadLetterCounts()[worker.ReasonHitTooOld]
+	sendGA(t,
+		map[string]interface{}{"uri": "/old", "created": time.Now().Add(-5 * time.Hour)},
+		map[string]interface{}{"uri": "/recent", "created": time.Now().Add(-time.Hour)})
+	if worker.DeadLetterCounts()[worker.ReasonHitTooOld] != before+1 {
+		t.Errorf("expected the hit queued for over 4 hours to be dead-lettered, got %v", worker.DeadLetterCounts())
+	}
+	batches := collector.Batches()
+	if len(batches) != 1 || len(batches[0]) != 1 || batches[0][0].Get("dp") != "/recent" {
+		t.Errorf("expected only the recent hit to be sent, got %v", batches)
+	}
+}
+
+func TestGAGivesUpAfterRetries(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	collector := newGACollector(http.StatusServiceUnavailable)
+	defer collector.Close()
+	viper.Set("ga.retries", 2)
+	viper.Set("ga.retry_backoff", 1)
+	before := worker.DeadLetterCounts()[worker.ReasonRetriesExhausted]
+	sendGA(t, map[string]interface{}{"uri": "/"})
+	if len(collector.Batches()) != 3 {
+		t.Errorf("expected the batch to be tried 3 times, got %v", len(collector.Batches()))
+	}
+	if worker.DeadLetterCounts()[worker.ReasonRetriesExhausted] != before+1 {
+		t.Errorf("expected the hit to be dead-lettered, got %v", worker.DeadLetterCounts())
+	}
+}
@@ -0,0 +1,178 @@
+package worker
+
+/*
+	grok.go expands grok-style patterns, like `%{IPORHOST:client} %{HTTPDATE:created}`,
+	into the regular expressions used to parse lines.
+
+	%{NAME} matches the named pattern, and %{NAME:field} also captures it as
+	field. As in Logstash, a type may follow the field (%{NUMBER:bytes:int}),
+	but it is ignored: values are converted by ParseStringForValue.
+
+	The bundled patterns may be added to, or replaced, by pattern files with
+	one `NAME pattern` definition per line (separated by spaces or tabs);
+	blank lines and lines starting with # are ignored.
+*/
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configParseGrokPatternFiles = "parse.grok_pattern_files"
+
+// GrokPatterns are the bundled grok patterns
+var GrokPatterns = map[string]string{
+	"USERNAME":     `[a-zA-Z0-9._-]+`,
+	"USER":         `%{USERNAME}`,
+	"EMAILADDRESS": `[a-zA-Z0-9!#$%&'*+/=?^_{|}~.-]+@%{HOSTNAME}`,
+	"INT":          `[+-]?[0-9]+`,
+	"BASE10NUM":    `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":       `%{BASE10NUM}`,
+	"BASE16NUM":    `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":       `\b[1-9][0-9]*\b`,
+	"NONNEGINT":    `\b[0-9]+\b`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":          `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4}`,
+
+	"IPV4":         `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6":         `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|%{IPV4})?(?:%[0-9A-Za-z]+)?`,
+	"IP":           `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":     `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":     `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT":     `%{IPORHOST}:%{POSINT}`,
+	"UNIXPATH":     `(?:/[^/\s]*)+`,
+	"WINPATH":      `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":         `%{UNIXPATH}|%{WINPATH}`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+.-]+`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	"MONTH":             `\b(?:[Jj]an(?:uary)?|[Ff]eb(?:ruary)?|[Mm]ar(?:ch)?|[Aa]pr(?:il)?|[Mm]ay|[Jj]un(?:e)?|[Jj]ul(?:y)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo]ct(?:ober)?|[Nn]ov(?:ember)?|[Dd]ec(?:ember)?)\b`,
+	"MONTHNUM":          `0?[1-9]|1[0-2]`,
+	"MONTHDAY":          `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":               `\b(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)\b`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `2[0123]|[01]?[0-9]`,
+	"MINUTE":            `[0-5][0-9]`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"DATE":              `%{DATE_US}|%{DATE_EU}`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"TZ":                `[A-Z]{3}`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?(?:%{ISO8601_TIMEZONE})?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"LOGLEVEL":          `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn?(?:ing)?|WARN?(?:ING)?|[Ee]rr?(?:or)?|ERR?(?:OR)?|[Cc]rit?(?:ical)?|CRIT?(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?`,
+
+	"COMMONAPACHELOG":   `%{IPORHOST:client} %{USER:ident} %{USER:user} \[%{HTTPDATE:created}\] "(?:%{WORD:method} %{NOTSPACE:uri}(?: HTTP/%{NUMBER:http_version})?|%{DATA})" %{NUMBER:status} (?:%{NUMBER:bytes}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} "%{DATA:referer}" "%{DATA:user_agent}"`,
+}
+
+// grokReference matches %{NAME}, %{NAME:field} and %{NAME:field:type}
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::\w+)?\}`)
+
+// Grok expands grok-style patterns
+type Grok struct {
+	patterns map[string]string
+}
+
+// NewGrok creates a Grok with the bundled patterns
+func NewGrok() *Grok {
+	g := &Grok{patterns: make(map[string]string, len(GrokPatterns))}
+	for name, pattern := range GrokPatterns {
+		g.patterns[name] = pattern
+	}
+	return g
+}
+
+// ConfiguredGrok creates a Grok with the bundled patterns and those of the
+// configured pattern files
+func ConfiguredGrok() *Grok {
+	g := NewGrok()
+	for _, fileName := range viper.GetStringSlice(configParseGrokPatternFiles) {
+		if err := g.AddPatternsFromFile(fileName); err != nil {
+			logs.Warn("Unable to read grok pattern file %s: %v", fileName, err)
+		}
+	}
+	return g
+}
+
+// AddPattern adds (or replaces) a named pattern
+func (g *Grok) AddPattern(name string, pattern string) {
+	g.patterns[name] = pattern
+}
+
+// AddPatternsFromFile adds the patterns defined in a pattern file
+func (g *Grok) AddPatternsFromFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end < 0 {
+			return fmt.Errorf("line %d has no pattern: %s", n, line)
+		}
+		g.AddPattern(line[:end], strings.TrimSpace(line[end:]))
+	}
+	return scanner.Err()
+}
+
+// Expand replaces the grok references in pattern with regular expressions
+func (g *Grok) Expand(pattern string) (string, error) {
+	return g.expand(pattern, map[string]bool{})
+}
+
+func (g *Grok) expand(pattern string, expanding map[string]bool) (string, error) {
+	var out []string
+	last := 0
+	for _, match := range grokReference.FindAllStringSubmatchIndex(pattern, -1) {
+		name := pattern[match[2]:match[3]]
+		definition, found := g.patterns[name]
+		if !found {
+			return "", fmt.Errorf("unknown grok pattern %s", name)
+		}
+		if expanding[name] {
+			return "", fmt.Errorf("grok pattern %s refers to itself", name)
+		}
+		expanding[name] = true
+		expanded, err := g.expand(definition, expanding)
+		delete(expanding, name)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, pattern[last:match[0]])
+		if match[4] >= 0 {
+			out = append(out, "(?P<"+pattern[match[4]:match[5]]+">"+expanded+")")
+		} else {
+			out = append(out, "(?:"+expanded+")")
+		}
+		last = match[1]
+	}
+	out = append(out, pattern[last:])
+	return strings.Join(out, ""), nil
+}
@@ -0,0 +1,90 @@
+package worker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+func TestGrokExpand(t *testing.T) {
+	g := worker.NewGrok()
+	g.AddPattern("GREETING", `hello|hi`)
+	g.AddPattern("PHRASE", `%{GREETING} %{WORD:name}`)
+	expanded, err := g.Expand(`^%{PHRASE:phrase}$`)
+	expected := `^(?P<phrase>(?:hello|hi) (?P<name>\b\w+\b))$`
+	if err != nil || expanded != expected {
+		t.Errorf("expected %s, got %s, %v", expected, expanded, err)
+	}
+	if _, err := g.Expand(`%{NO_SUCH_PATTERN}`); err == nil {
+		t.Errorf("expected an unknown pattern to fail")
+	}
+	g.AddPattern("LOOP", `a%{LOOP}`)
+	if _, err := g.Expand(`%{LOOP}`); err == nil {
+		t.Errorf("expected a recursive pattern to fail")
+	}
+}
+
+func TestGrokParseEvents(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("parse.pattern", `%{IPORHOST:client} %{USER:ident} %{USER:user} \[%{HTTPDATE:created}\] "%{WORD:method} %{NOTSPACE:uri} HTTP/%{NUMBER:http_version}" %{INT:status:int} %{NUMBER:bytes}`)
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif?size=3 HTTP/1.0" 200 2326`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	good := map[string]interface{}{"client": "127.0.0.1", "user": "frank", "method": "GET", "size": int64(3),
+		"http_version": 1.0, "status": int64(200), "bytes": int64(2326)}
+	for key, kv := range good {
+		if m[key] != kv {
+			t.Errorf("Testing for %v; expected: %v, actual: %v", key, kv, m[key])
+		}
+	}
+	if created, ok := m["created"].(time.Time); !ok || !created.Equal(time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC)) {
+		t.Errorf("expected created to be parsed, got %v", m["created"])
+	}
+}
+
+func TestGrokPatternFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "patterns")
+	ioutil.WriteFile(fileName, []byte("# request ids\nREQUEST_ID\treq-%{INT}\n\n"), 0644)
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("parse.grok_pattern_files", []string{fileName})
+	viper.Set("parse.pattern", `%{REQUEST_ID:request} %{COMBINEDAPACHELOG}`)
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`req-42 10.1.1.1 - - [17/May/2015:08:05:32 +0000] "GET /x HTTP/1.1" 304 0 "-" "curl"`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	if m["request"] != "req-42" || m["user_agent"] != "curl" || m["status"] != int64(304) {
+		t.Errorf("unexpected event %v", m)
+	}
+}
+
+func TestGrokRepeatedFieldNames(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("parse.pattern", `(?:%{IP:client}|%{HOSTNAME:client}) %{WORD:method}`)
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`10.1.1.1 GET`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	if m["client"] != "10.1.1.1" {
+		t.Errorf("expected the group which matched to give client, got %v", m["client"])
+	}
+}
@@ -16,9 +16,12 @@ import (
 	"math"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ActiveState/tail"
@@ -27,8 +30,12 @@ import (
 )
 
 const configParseInputFile = "parse.input_file"
+const configParseInputFiles = "parse.input_files"
+const configParseSourceKey = "parse.source_key"
+const configParseRescanInterval = "parse.rescan_interval"
 const configParseKeysToIgnore = "parse.keys_to_ignore"
 const configParsePattern = "parse.pattern"
+const configParseFormat = "parse.format"
 const configParseTimePatterns = "parse.time_patterns"
 const configTailFromBeginning = "tail.from_beginning"
 const configTailReopen = "tail.reopen"
@@ -36,14 +43,49 @@ const configTailReopen = "tail.reopen"
 // DefaultParseLogPattern is the default pattern for understanding log patterns
 const DefaultParseLogPattern = `(?P<line>.*)` // `(?P<host>\S+) (?P<client>\S+) (?P<user>\S+) \[(?P<created>[^\]]+)\] "((?P<method>[A-Z]+) )?(?P<uri>\S+).*"`
 
+// Input formats understood by the LogParser
+const (
+	FormatRegex    = "regex"  // lines matched by parse.pattern
+	FormatJSON     = "json"   // one JSON object per line
+	FormatLogfmt   = "logfmt" // key=value pairs, as in logfmt
+	FormatKeyValue = "kv"     // key/value pairs with configurable delimiters
+	FormatSyslog   = "syslog" // RFC 5424 or RFC 3164 syslog lines
+	FormatRFC3164  = "rfc3164"
+	FormatRFC5424  = "rfc5424"
+)
+
+// DefaultSourceKey is the default name of the key holding the path an event was read from
+const DefaultSourceKey = "source"
+
+// DefaultRescanInterval is the default number of seconds between checks for
+// new files matching the input glob patterns
+const DefaultRescanInterval = 10
+
 // LogParser parses the imput and puts events on a channel
 type LogParser struct {
-	Channel      chan map[string]interface{}
-	TimePatterns []string
-	tailer       *tail.Tail
-	Regex        *regexp.Regexp
-	pattern      string
-	keysToIgnore map[string]bool
+	Channel        chan map[string]interface{}
+	TimePatterns   []string
+	tailers        map[string]*tail.Tail
+	tailersLock    sync.Mutex
+	quit           chan bool
+	stopOnce       sync.Once
+	Regex          *regexp.Regexp
+	pattern        string
+	format         string
+	jsonInferTypes bool
+	jsonExpandURI  bool
+	pairDelimiter  string
+	valueDelimiter string
+	syslogLocation *time.Location
+	keysToIgnore   map[string]bool
+	sourceKey      string
+	rescanInterval time.Duration
+	checkpoint     *Checkpoint
+	multiline      *Multiline
+	grok           *Grok
+	patterns       []namedRegex
+	patternKey     string
+	queue          *Queue
 }
 
 func newKeyName(k string, m map[string]interface{}) string {
@@ -168,34 +210,114 @@ func (w *LogParser) ParseURI(uri string, v map[string]interface{}) {
 	}
 }
 
-// ParseEvents parses the line (including a call to ParseURI) to
+// ParseEvents parses the line according to the configured format to
 // add events to the map of strings -> anything. It returns that map
 func (w *LogParser) ParseEvents(line string) (map[string]interface{}, error) {
-	v := make(map[string]interface{})
-	regex := w.Regex
-	match := regex.FindStringSubmatch(line)
-	names := regex.SubexpNames()
-	if match != nil {
-		for i, submatch := range match {
-			name := names[i]
-			if !w.shouldIgnore(name) {
-				v[names[i]] = w.ParseStringForValue(submatch)
-			}
-			if name == "uri" {
-				w.ParseURI(submatch, v)
+	switch w.format {
+	case FormatJSON:
+		return w.ParseJSON(line)
+	case FormatLogfmt:
+		return w.ParseLogfmt(line)
+	case FormatKeyValue:
+		return w.ParseKeyValues(line, w.pairDelimiter, w.valueDelimiter)
+	case FormatSyslog:
+		return w.ParseSyslog(line)
+	case FormatRFC3164:
+		return w.ParseRFC3164(line)
+	case FormatRFC5424:
+		return w.ParseRFC5424(line)
+	}
+	return w.ParseRegex(line)
+}
+
+// ParseRegex parses the line with the regex (including a call to ParseURI).
+// If parse.patterns is set, its patterns are tried in turn, and the name
+// of the first which matches is added to the event.
+func (w *LogParser) ParseRegex(line string) (map[string]interface{}, error) {
+	if len(w.patterns) == 0 {
+		if v := w.matchRegex(w.Regex, line); v != nil {
+			return v, nil
+		}
+	}
+	for _, named := range w.patterns {
+		if v := w.matchRegex(named.regex, line); v != nil {
+			if !w.shouldIgnore(w.patternKey) {
+				v[newKeyName(w.patternKey, v)] = named.name
 			}
+			return v, nil
 		}
-		return v, nil
 	}
 	logs.Debug("Line %s did not match pattern.", line)
 	return nil, fmt.Errorf("Line %s did not match pattern.", line)
 }
 
-// converts w config into tail Config
-func (w *LogParser) convertConfig() (config tail.Config) {
-	if !viper.GetBool(configTailFromBeginning) {
-		config.Location = &tail.SeekInfo{0, os.SEEK_END}
+// matchRegex returns the event for a line matching regex, or nil
+func (w *LogParser) matchRegex(regex *regexp.Regexp, line string) map[string]interface{} {
+	match := regex.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+	v := make(map[string]interface{})
+	names := regex.SubexpNames()
+	for i, submatch := range match {
+		name := names[i]
+		if _, found := v[name]; found && submatch == "" {
+			// a group of the same name, like the other side of
+			// %{IP:client}|%{HOSTNAME:client}, has matched already
+			continue
+		}
+		if !w.shouldIgnore(name) {
+			v[names[i]] = w.ParseStringForValue(submatch)
+		}
+		if name == "uri" {
+			w.ParseURI(submatch, v)
+		}
+	}
+	return v
+}
+
+// ConfiguredInputFiles returns the paths and glob patterns of the files to tail,
+// including the single file named by parse.input_file
+func ConfiguredInputFiles() []string {
+	patterns := viper.GetStringSlice(configParseInputFiles)
+	if viper.IsSet(configParseInputFile) {
+		patterns = append(patterns, viper.GetString(configParseInputFile))
 	}
+	return patterns
+}
+
+// ExpandInputFiles expands glob patterns into a sorted list of unique paths.
+// Plain paths are kept even if the file does not exist yet, so that tail can
+// wait for it to be created.
+func ExpandInputFiles(patterns []string) []string {
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			seen[pattern] = pattern != ""
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			logs.Warn("Invalid input file pattern %s: %v", pattern, err)
+			continue
+		}
+		for _, match := range matches {
+			seen[match] = true
+		}
+	}
+	paths := make([]string, 0, len(seen))
+	for path, ok := range seen {
+		if ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// converts w config into tail Config, starting at location
+func (w *LogParser) convertConfig(location *tail.SeekInfo) (config tail.Config) {
+	config.Location = location
 	config.ReOpen = viper.GetBool(configTailReopen)
 	config.Follow = true
 	config.Logger = tail.DiscardingLogger
@@ -203,18 +325,41 @@ func (w *LogParser) convertConfig() (config tail.Config) {
 	return
 }
 
+// SetWorkChannel sets the channel events are put on, blocking until
+// they are taken
 func (w *LogParser) SetWorkChannel(channel chan map[string]interface{}) {
 	w.Channel = channel
+	w.queue = &Queue{Policy: QueueBlock, items: channel}
+}
+
+// SetQueue sets the queue events are put on
+func (w *LogParser) SetQueue(queue *Queue) {
+	w.Channel = queue.Channel()
+	w.queue = queue
 }
 
 // recompile regex if necessaary ...
 
 func (w *LogParser) ConfigureRegex() {
 	pattern := viper.GetString(configParsePattern)
+	if name := viper.GetString(configParsePreset); name != "" {
+		preset, found := Presets[name]
+		if !found {
+			logs.Warn("Unknown preset %s", name)
+		} else if pattern != "" {
+			logs.Warn("Both %s and %s are set; using the pattern", configParsePattern, configParsePreset)
+		} else {
+			pattern = preset.Pattern
+			w.TimePatterns = append(w.TimePatterns, preset.TimePatterns...)
+		}
+	}
 	if pattern == "" {
 		pattern = DefaultParseLogPattern
+		if w.multiline != nil {
+			pattern = "(?s)" + pattern // joined lines must match too
+		}
 	}
-	regex, err := regexp.Compile(pattern)
+	regex, err := w.compilePattern(pattern)
 	if err != nil {
 		logs.Warn("Could not compile Regex. Error: %v", err)
 	} else {
@@ -223,54 +368,262 @@ func (w *LogParser) ConfigureRegex() {
 	}
 }
 
+// compilePattern compiles a pattern, expanding any grok references
+func (w *LogParser) compilePattern(pattern string) (*regexp.Regexp, error) {
+	if strings.Contains(pattern, "%{") {
+		if w.grok == nil {
+			w.grok = ConfiguredGrok()
+		}
+		expanded, err := w.grok.Expand(pattern)
+		if err != nil {
+			return nil, err
+		}
+		pattern = expanded
+	}
+	return regexp.Compile(pattern)
+}
+
+// ConfigureFormat sets the input format
+func (w *LogParser) ConfigureFormat() {
+	w.format = strings.ToLower(viper.GetString(configParseFormat))
+	switch w.format {
+	case "":
+		w.format = FormatRegex
+	case FormatRegex:
+	case FormatJSON:
+		w.jsonInferTypes = viper.GetBool(configParseJSONInferTypes)
+		w.jsonExpandURI = viper.GetBool(configParseJSONExpandURI)
+	case FormatLogfmt:
+	case FormatKeyValue:
+		w.pairDelimiter = DefaultKVPairDelimiter
+		if viper.IsSet(configParseKVPairDelimiter) {
+			w.pairDelimiter = viper.GetString(configParseKVPairDelimiter)
+		}
+		w.valueDelimiter = DefaultKVValueDelimiter
+		if viper.GetString(configParseKVValueDelimiter) != "" {
+			w.valueDelimiter = viper.GetString(configParseKVValueDelimiter)
+		}
+	case FormatSyslog, FormatRFC3164, FormatRFC5424:
+		w.syslogLocation = ConfiguredSyslogTimezone()
+	default:
+		logs.Warn("Unknown input format %s; using %s", w.format, FormatRegex)
+		w.format = FormatRegex
+	}
+}
+
 // Init initializes worker's Regex
 func (w *LogParser) Init() {
 	w.TimePatterns = viper.GetStringSlice(configParseTimePatterns)
+	w.multiline = ConfiguredMultiline()
+	w.ConfigureFormat()
 	w.ConfigureRegex()
+	w.ConfigurePatterns()
 	w.keysToIgnore = map[string]bool{}
 	for _, key := range viper.GetStringSlice(configParseKeysToIgnore) {
 		w.keysToIgnore[key] = true
 	}
+	w.sourceKey = DefaultSourceKey
+	if viper.IsSet(configParseSourceKey) {
+		w.sourceKey = viper.GetString(configParseSourceKey)
+	}
+	w.rescanInterval = DefaultRescanInterval * time.Second
+	if viper.IsSet(configParseRescanInterval) {
+		w.rescanInterval = time.Duration(viper.GetInt(configParseRescanInterval)) * time.Second
+	}
+	if w.tailers == nil {
+		w.tailers = map[string]*tail.Tail{}
+	}
+	if w.quit == nil {
+		w.quit = make(chan bool)
+	}
+	if w.checkpoint == nil {
+		w.checkpoint = ConfiguredCheckpoint()
+	}
 }
 
 // Start starts the LogWorker.
-// it starts tailing the log file, and parsing lines from it
-// putting parsed lines on the shared channel.
+// it starts tailing the input files, and parsing lines from them
+// putting parsed lines on the shared channel. Glob patterns are
+// checked again every rescan interval, so that new files are picked up.
 func (w *LogParser) Start() {
 	logs.Info("Starting LOG PARSING process")
 	w.Init()
-	inputFile := viper.GetString(configParseInputFile)
-	tcfg := w.convertConfig()
-	// tcfg := tail.Config{Follow: true, ReOpen: true, Logger: tail.DiscardingLogger, Poll: true}
-	logs.Info("tail config: ReOpen? %v; MustExist? %v; Follow? %v; Poll? %v; Pipe? %v",
-		tcfg.ReOpen, tcfg.MustExist, tcfg.Follow, tcfg.Poll, tcfg.Pipe)
-	t, err := tail.TailFile(inputFile, tcfg)
+	patterns := ConfiguredInputFiles()
+	if len(patterns) == 0 {
+		logs.Warn("No input files configured; set %s or %s", configParseInputFiles, configParseInputFile)
+	}
+	w.scanInputFiles(patterns, viper.GetBool(configTailFromBeginning))
+	var rescan, save <-chan time.Time
+	if w.rescanInterval > 0 {
+		ticker := time.NewTicker(w.rescanInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	if w.checkpoint != nil && ConfiguredCheckpointInterval() > 0 {
+		ticker := time.NewTicker(time.Duration(ConfiguredCheckpointInterval()) * time.Second)
+		defer ticker.Stop()
+		save = ticker.C
+	}
+	for {
+		select {
+		case <-rescan:
+			w.scanInputFiles(patterns, true)
+		case <-save:
+			w.SaveCheckpoint()
+		case <-w.quit:
+			logs.Info("Stopping worker process")
+			return
+		}
+	}
+}
+
+// SaveCheckpoint saves the delivered positions of the input files, if
+// a checkpoint file is configured
+func (w *LogParser) SaveCheckpoint() {
+	if err := w.checkpoint.Save(); err != nil {
+		logs.Warn("Unable to save checkpoint file %s: %v", w.checkpoint.FileName, err)
+	}
+}
+
+// scanInputFiles starts tailing any file matching the patterns which is not
+// already being tailed
+func (w *LogParser) scanInputFiles(patterns []string, fromBeginning bool) {
+	for _, path := range ExpandInputFiles(patterns) {
+		w.tailersLock.Lock()
+		_, found := w.tailers[path]
+		w.tailersLock.Unlock()
+		if !found {
+			w.tailFile(path, fromBeginning)
+		}
+	}
+}
+
+// startLocation decides where to start reading the file at path: from the
+// checkpoint if it knows the file, otherwise from the beginning or the end.
+// It returns the identity of the file and the offset reading starts at.
+func (w *LogParser) startLocation(path string, fromBeginning bool) (id FileID, offset int64, location *tail.SeekInfo) {
+	id, size, err := StatFile(path)
 	if err != nil {
-		logs.Warn("Input file could not be opened: %s; error: %s", inputFile, err)
+		return
+	}
+	offset, found := w.checkpoint.ResumeOffset(path, id, size)
+	if found {
+		logs.Info("Resuming %s at offset %d", path, offset)
+		location = &tail.SeekInfo{Offset: offset, Whence: os.SEEK_SET}
+	} else if !fromBeginning {
+		offset = size
+		location = &tail.SeekInfo{Offset: size, Whence: os.SEEK_SET}
+	}
+	return
+}
 
-	} else {
-		w.tailer = t
-		for line := range t.Lines {
-			s := strings.TrimSpace(line.Text)
-			logs.Debug("Processing line %v", s)
-			v, err := w.ParseEvents(s)
-			if err == nil {
-				go func() {
-					w.Channel <- v
-				}()
+// tailFile starts tailing a single file, parsing its lines in
+// a separate goroutine
+func (w *LogParser) tailFile(path string, fromBeginning bool) {
+	id, offset, location := w.startLocation(path, fromBeginning)
+	tcfg := w.convertConfig(location)
+	logs.Info("tail config for %s: ReOpen? %v; MustExist? %v; Follow? %v; Poll? %v; Pipe? %v",
+		path, tcfg.ReOpen, tcfg.MustExist, tcfg.Follow, tcfg.Poll, tcfg.Pipe)
+	t, err := tail.TailFile(path, tcfg)
+	if err != nil {
+		logs.Warn("Input file could not be opened: %s; error: %s", path, err)
+		return
+	}
+	w.tailersLock.Lock()
+	w.tailers[path] = t
+	w.tailersLock.Unlock()
+	w.checkpoint.Open(path, id, offset)
+	go func() {
+		// find where each line ends, noticing when the file is rotated or truncated
+		locator := NewLineLocator(path, offset)
+		defer locator.Close()
+		// send on joined lines which have waited too long for more
+		var multiline *Multiline
+		var timeout <-chan time.Time
+		if w.multiline != nil {
+			multiline = w.multiline.New()
+		}
+		for {
+			select {
+			case line, ok := <-t.Lines:
+				if !ok {
+					if multiline != nil {
+						w.processEvents(path, multiline.Flush())
+					}
+					logs.Info("Stopped tailing %s", path)
+					w.tailersLock.Lock()
+					delete(w.tailers, path)
+					w.tailersLock.Unlock()
+					return
+				}
+				offset, reopened := locator.Locate(line.Text)
+				if reopened {
+					logs.Info("%s was rotated or truncated; reading it from the start", path)
+					if multiline != nil {
+						w.processEvents(path, multiline.Flush())
+					}
+					w.checkpoint.Open(path, locator.ID, 0)
+				}
+				if multiline == nil {
+					w.processLine(path, line.Text, offset)
+					break
+				}
+				w.processEvents(path, multiline.Add(line.Text, offset))
+				if multiline.Timeout > 0 {
+					timeout = time.After(multiline.Timeout)
+				}
+			case <-timeout:
+				w.processEvents(path, multiline.Flush())
 			}
 		}
+	}()
+}
+
+// processEvents processes lines joined by a Multiline
+func (w *LogParser) processEvents(path string, events []MultilineEvent) {
+	for _, event := range events {
+		w.processLine(path, event.Text, event.Offset)
+	}
+}
+
+// processLine parses a line read from path, ending at offset, and puts the
+// event on the channel
+func (w *LogParser) processLine(path string, line string, offset int64) {
+	ack := w.checkpoint.Track(path, offset)
+	s := strings.TrimSpace(line)
+	logs.Debug("Processing line %v from %s", s, path)
+	v, err := w.ParseEvents(s)
+	if err != nil {
+		DeadLetterLine(path, offset, line, ReasonUnmatched, err)
+		ack()
+		return
+	}
+	w.tagSource(path, v)
+	v[MetadataKey] = &EventMetadata{Source: path, Offset: offset, Raw: line, ack: ack}
+	w.queue.Put(v)
+}
+
+// tagSource records the path of the file the event was read from
+func (w *LogParser) tagSource(path string, v map[string]interface{}) {
+	if !w.shouldIgnore(w.sourceKey) {
+		v[newKeyName(w.sourceKey, v)] = path
 	}
-	logs.Info("Stopping worker process")
 }
 
 // Stop stops the worker and cleans up. Does *not* stop ElasticSearchWorker
 func (w *LogParser) Stop() {
-	if w.tailer != nil {
+	w.stopOnce.Do(func() {
+		if w.quit != nil {
+			close(w.quit)
+		}
+	})
+	w.tailersLock.Lock()
+	defer w.tailersLock.Unlock()
+	for path, t := range w.tailers {
 		//logs.Debug("Stopping tailer")
 		//err := w.tailer.Stop()
-		logs.Debug("Cleaning up tailer")
-		w.tailer.Cleanup()
-		logs.Debug("Done stopping tailer")
+		logs.Debug("Cleaning up tailer for %s", path)
+		t.Cleanup()
 	}
+	logs.Debug("Done stopping tailers")
 }
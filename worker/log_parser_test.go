@@ -2,7 +2,10 @@ package worker_test
 
 import (
 	"bytes"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -202,3 +205,41 @@ func TestParseBool(t *testing.T) {
 		}
 	}
 }
+
+func TestExpandInputFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b.access.log", "a.access.log", "error.log"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+	}
+	missing := filepath.Join(dir, "not-yet.log")
+	patterns := []string{filepath.Join(dir, "*.access.log"), missing, filepath.Join(dir, "a.access.log")}
+	expected := []string{filepath.Join(dir, "a.access.log"), filepath.Join(dir, "b.access.log"), missing}
+	actual := worker.ExpandInputFiles(patterns)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, actual %v", expected, actual)
+	}
+}
+
+func TestConfiguredInputFiles(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.input_files", []string{"/var/log/nginx/*.access.log"})
+	viper.Set("parse.input_file", "/tmp/example.log")
+	expected := []string{"/var/log/nginx/*.access.log", "/tmp/example.log"}
+	actual := worker.ConfiguredInputFiles()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, actual %v", expected, actual)
+	}
+}
+
+func TestLogParserStopTwice(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	w := &worker.LogParser{}
+	w.Init()
+	w.Stop()
+	w.Stop()
+}
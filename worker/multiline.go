@@ -0,0 +1,111 @@
+package worker
+
+/*
+	multiline.go joins several lines of a log into a single event, so that
+	things like stack traces are parsed as one event.
+
+	Either a start pattern (lines matching it begin a new event, other lines
+	continue the current one) or a continuation pattern (lines matching it
+	continue the current event, other lines begin a new one) is configured.
+*/
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configMultilineStartPattern = "parse.multiline.start_pattern"
+const configMultilineContinuationPattern = "parse.multiline.continuation_pattern"
+const configMultilineMaxLines = "parse.multiline.max_lines"
+const configMultilineTimeout = "parse.multiline.timeout"
+
+// DefaultMultilineMaxLines is the default maximum number of lines joined into one event
+const DefaultMultilineMaxLines = 500
+
+// DefaultMultilineTimeout is the default number of seconds to wait for more
+// lines before an event is sent on
+const DefaultMultilineTimeout = 2
+
+// MultilineEvent is the text of several joined lines, and the offset just
+// past the last of them
+type MultilineEvent struct {
+	Text   string
+	Offset int64
+}
+
+// Multiline joins the lines of one file into events
+type Multiline struct {
+	Start        *regexp.Regexp
+	Continuation *regexp.Regexp
+	MaxLines     int
+	Timeout      time.Duration
+	lines        []string
+	offset       int64
+}
+
+// ConfiguredMultiline returns the configured multiline settings, or nil if
+// lines are not to be joined
+func ConfiguredMultiline() *Multiline {
+	start := viper.GetString(configMultilineStartPattern)
+	continuation := viper.GetString(configMultilineContinuationPattern)
+	if start == "" && continuation == "" {
+		return nil
+	}
+	m := &Multiline{MaxLines: DefaultMultilineMaxLines, Timeout: DefaultMultilineTimeout * time.Second}
+	var err error
+	if start != "" {
+		m.Start, err = regexp.Compile(start)
+	} else {
+		m.Continuation, err = regexp.Compile(continuation)
+	}
+	if err != nil {
+		logs.Warn("Could not compile multiline pattern; lines will not be joined. Error: %v", err)
+		return nil
+	}
+	if viper.IsSet(configMultilineMaxLines) {
+		m.MaxLines = viper.GetInt(configMultilineMaxLines)
+	}
+	if viper.IsSet(configMultilineTimeout) {
+		m.Timeout = time.Duration(viper.GetInt(configMultilineTimeout)) * time.Second
+	}
+	return m
+}
+
+// New returns an empty Multiline with the same settings, for another file
+func (m *Multiline) New() *Multiline {
+	return &Multiline{Start: m.Start, Continuation: m.Continuation, MaxLines: m.MaxLines, Timeout: m.Timeout}
+}
+
+// startsEvent tells whether line begins a new event
+func (m *Multiline) startsEvent(line string) bool {
+	if m.Start != nil {
+		return m.Start.MatchString(line)
+	}
+	return !m.Continuation.MatchString(line)
+}
+
+// Add adds a line ending at offset, and returns any events it completes
+func (m *Multiline) Add(line string, offset int64) (events []MultilineEvent) {
+	if len(m.lines) > 0 && m.startsEvent(line) {
+		events = append(events, m.Flush()...)
+	}
+	m.lines = append(m.lines, line)
+	m.offset = offset
+	if m.MaxLines > 0 && len(m.lines) >= m.MaxLines {
+		events = append(events, m.Flush()...)
+	}
+	return
+}
+
+// Flush returns the event being collected, if there is one
+func (m *Multiline) Flush() (events []MultilineEvent) {
+	if len(m.lines) == 0 {
+		return
+	}
+	events = append(events, MultilineEvent{Text: strings.Join(m.lines, "\n"), Offset: m.offset})
+	m.lines = nil
+	return
+}
@@ -0,0 +1,96 @@
+package worker_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+var stackTrace = []string{
+	"2016-04-01 11:00:00 ERROR request failed",
+	"java.lang.NullPointerException",
+	"\tat org.example.Handler.handle(Handler.java:42)",
+	"\tat org.example.Server.run(Server.java:7)",
+	"2016-04-01 11:00:01 INFO request done",
+}
+
+func addLines(m *worker.Multiline, lines []string) (events []worker.MultilineEvent) {
+	var offset int64
+	for _, line := range lines {
+		offset += int64(len(line)) + 1
+		events = append(events, m.Add(line, offset)...)
+	}
+	return
+}
+
+func TestMultilineStartPattern(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.multiline.start_pattern", `^\d{4}-\d{2}-\d{2} `)
+	m := worker.ConfiguredMultiline().New()
+	events := addLines(m, stackTrace)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 complete event, got %v", events)
+	}
+	expected := "2016-04-01 11:00:00 ERROR request failed\njava.lang.NullPointerException\n\tat org.example.Handler.handle(Handler.java:42)\n\tat org.example.Server.run(Server.java:7)"
+	if events[0].Text != expected || events[0].Offset != int64(len(expected))+1 {
+		t.Errorf("expected %q ending at %v, got %q ending at %v", expected, len(expected)+1, events[0].Text, events[0].Offset)
+	}
+	last := m.Flush()
+	if len(last) != 1 || last[0].Text != stackTrace[4] {
+		t.Errorf("expected flush to return %q, got %v", stackTrace[4], last)
+	}
+}
+
+func TestMultilineContinuationPattern(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.multiline.continuation_pattern", `^(\s|java\.)`)
+	m := worker.ConfiguredMultiline().New()
+	events := append(addLines(m, stackTrace), m.Flush()...)
+	if len(events) != 2 {
+		t.Errorf("expected 2 events, got %v", events)
+	}
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.multiline.start_pattern", `^\d{4}-\d{2}-\d{2} `)
+	viper.Set("parse.multiline.max_lines", 2)
+	m := worker.ConfiguredMultiline().New()
+	var texts []string
+	for _, event := range append(addLines(m, stackTrace), m.Flush()...) {
+		texts = append(texts, event.Text)
+	}
+	expected := []string{
+		stackTrace[0] + "\n" + stackTrace[1],
+		stackTrace[2] + "\n" + stackTrace[3],
+		stackTrace[4],
+	}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Errorf("expected %q, got %q", expected, texts)
+	}
+}
+
+func TestMultilineNotConfigured(t *testing.T) {
+	viper.Reset()
+	if worker.ConfiguredMultiline() != nil {
+		t.Errorf("expected no multiline settings")
+	}
+}
+
+func TestParseEventsMultilineDefaultPattern(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("toml")
+	viper.ReadConfig(bytes.NewBufferString(`
+[parse.multiline]
+start_pattern = '^\S'
+`))
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents("first\n  second")
+	if err != nil || m["line"] != "first\n  second" {
+		t.Errorf("expected joined lines to match the default pattern, got %v, %v", m, err)
+	}
+}
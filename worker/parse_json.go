@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fizx/logs"
+)
+
+const configParseJSONInferTypes = "parse.json.infer_types"
+const configParseJSONExpandURI = "parse.json.expand_uri"
+
+// ParseJSON decodes a line holding a JSON object into an event. Nested
+// objects and arrays are kept. Numbers become int64 if they are whole, and
+// float64 otherwise, as they would from ParseStringForValue.
+// If parse.json.infer_types is set, string values are converted with
+// ParseStringForValue; if parse.json.expand_uri is set, the query parameters
+// of a "uri" string are added to the event, as with ParseURI. A line with
+// anything but white space after the object does not parse.
+func (w *LogParser) ParseJSON(line string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil || obj == nil {
+		logs.Debug("Line %s is not a JSON object.", line)
+		return nil, fmt.Errorf("Line %s is not a JSON object.", line)
+	}
+	// the object must be all there is on the line
+	if _, err := decoder.Token(); err != io.EOF {
+		logs.Debug("Line %s has more than a JSON object.", line)
+		return nil, fmt.Errorf("Line %s has more than a JSON object.", line)
+	}
+	v := make(map[string]interface{}, len(obj))
+	for key, value := range obj {
+		if !w.shouldIgnore(key) {
+			v[key] = w.convertJSONValue(value)
+		}
+	}
+	if uri, ok := obj["uri"].(string); ok && w.jsonExpandURI {
+		w.ParseURI(uri, v)
+	}
+	return v, nil
+}
+
+// convertJSONValue converts decoded numbers, and strings if types are
+// inferred, within value
+func (w *LogParser) convertJSONValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case string:
+		if w.jsonInferTypes {
+			return w.ParseStringForValue(value)
+		}
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = w.convertJSONValue(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = w.convertJSONValue(v)
+		}
+	}
+	return value
+}
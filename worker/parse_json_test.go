@@ -0,0 +1,80 @@
+package worker_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+const jsonLine = `{"created":"2016-04-01T11:00:00Z","status":"200","dur":12,"ratio":0.5,"uri":"/q?age=47","user":{"name":"bob","id":7},"tags":["a",1]}`
+
+func TestParseJSON(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "json")
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(jsonLine)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	good := map[string]interface{}{
+		"created": "2016-04-01T11:00:00Z",
+		"status":  "200",
+		"dur":     int64(12),
+		"ratio":   0.5,
+		"uri":     "/q?age=47",
+		"user":    map[string]interface{}{"name": "bob", "id": int64(7)},
+		"tags":    []interface{}{"a", int64(1)},
+	}
+	if !reflect.DeepEqual(m, good) {
+		t.Errorf("expected %v, actual %v", good, m)
+	}
+}
+
+func TestParseJSONInferTypes(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "json")
+	viper.Set("parse.json.infer_types", true)
+	viper.Set("parse.json.expand_uri", true)
+	viper.Set("parse.keys_to_ignore", []string{"tags"})
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(jsonLine)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	if m["status"] != int64(200) || m["age"] != int64(47) {
+		t.Errorf("expected status and age to be numbers, got %v", m)
+	}
+	if _, ok := m["created"].(time.Time); !ok {
+		t.Errorf("expected created to be a time, got %v", reflect.TypeOf(m["created"]))
+	}
+	if _, found := m["tags"]; found {
+		t.Errorf("expected tags to be ignored")
+	}
+}
+
+func TestParseJSONNotAnObject(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "json")
+	w := &worker.LogParser{}
+	w.Init()
+	for _, line := range []string{`[1,2]`, `not json`, `null`, `{"a":1} junk`, `{"a":1}{"b":2}`} {
+		if _, err := w.ParseEvents(line); err == nil {
+			t.Errorf("expected %s not to parse", line)
+		}
+	}
+}
+
+func TestParseJSONTrailingSpace(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "json")
+	w := &worker.LogParser{}
+	w.Init()
+	if _, err := w.ParseEvents(`{"a":1}   `); err != nil {
+		t.Errorf("expected white space after the object to be ignored, got %v", err)
+	}
+}
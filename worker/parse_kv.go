@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/fizx/logs"
+)
+
+const configParseKVPairDelimiter = "parse.kv.pair_delimiter"
+const configParseKVValueDelimiter = "parse.kv.value_delimiter"
+
+// DefaultKVPairDelimiter is the default delimiter between key/value pairs
+const DefaultKVPairDelimiter = " "
+
+// DefaultKVValueDelimiter is the default delimiter between a key and its value
+const DefaultKVValueDelimiter = "="
+
+// ParseLogfmt parses a logfmt line, such as `level=info msg="request done"
+// dur=12ms status=200`, into an event.
+func (w *LogParser) ParseLogfmt(line string) (map[string]interface{}, error) {
+	return w.ParseKeyValues(line, DefaultKVPairDelimiter, DefaultKVValueDelimiter)
+}
+
+// ParseKeyValues parses a line of key/value pairs into an event. Pairs are
+// separated by pairDelimiter (if it is blank, by any run of white space),
+// and keys from values by valueDelimiter. Values may be double quoted, with
+// backslash escapes. A key without a value is true, as in logfmt. Each value
+// is converted with ParseStringForValue, and the query parameters of a "uri"
+// value are added as with ParseURI.
+func (w *LogParser) ParseKeyValues(line string, pairDelimiter string, valueDelimiter string) (map[string]interface{}, error) {
+	s := &kvScanner{line: line, pairDelimiter: pairDelimiter, valueDelimiter: valueDelimiter}
+	v := make(map[string]interface{})
+	for s.skipPairDelimiters() {
+		key := s.key()
+		var value interface{} = true
+		if s.consume(s.valueDelimiter) {
+			str, err := s.value()
+			if err != nil {
+				logs.Debug("Line %s has bad key/value pairs: %v", line, err)
+				return nil, fmt.Errorf("Line %s has bad key/value pairs: %v", line, err)
+			}
+			value = w.ParseStringForValue(str)
+			if key == "uri" {
+				w.ParseURI(str, v)
+			}
+		}
+		if !w.shouldIgnore(key) {
+			v[key] = value
+		}
+	}
+	if len(v) == 0 {
+		logs.Debug("Line %s has no key/value pairs.", line)
+		return nil, fmt.Errorf("Line %s has no key/value pairs.", line)
+	}
+	return v, nil
+}
+
+// kvScanner reads key/value pairs from a line
+type kvScanner struct {
+	line           string
+	pos            int
+	pairDelimiter  string
+	valueDelimiter string
+}
+
+func (s *kvScanner) atPairDelimiter() bool {
+	if strings.TrimSpace(s.pairDelimiter) == "" {
+		return s.pos < len(s.line) && unicode.IsSpace(rune(s.line[s.pos]))
+	}
+	return strings.HasPrefix(s.line[s.pos:], s.pairDelimiter)
+}
+
+// skipPairDelimiters moves past delimiters, and tells whether anything is left
+func (s *kvScanner) skipPairDelimiters() bool {
+	for s.pos < len(s.line) && s.atPairDelimiter() {
+		if strings.TrimSpace(s.pairDelimiter) == "" {
+			s.pos++
+		} else {
+			s.pos += len(s.pairDelimiter)
+		}
+	}
+	return s.pos < len(s.line)
+}
+
+func (s *kvScanner) consume(delimiter string) bool {
+	if strings.HasPrefix(s.line[s.pos:], delimiter) {
+		s.pos += len(delimiter)
+		return true
+	}
+	return false
+}
+
+func (s *kvScanner) key() string {
+	start := s.pos
+	for s.pos < len(s.line) && !s.atPairDelimiter() && !strings.HasPrefix(s.line[s.pos:], s.valueDelimiter) {
+		s.pos++
+	}
+	return strings.TrimSpace(s.line[start:s.pos])
+}
+
+func (s *kvScanner) value() (string, error) {
+	if s.pos < len(s.line) && s.line[s.pos] == '"' {
+		return s.quoted()
+	}
+	start := s.pos
+	for s.pos < len(s.line) && !s.atPairDelimiter() {
+		s.pos++
+	}
+	return s.line[start:s.pos], nil
+}
+
+func (s *kvScanner) quoted() (string, error) {
+	var value []byte
+	for s.pos++; s.pos < len(s.line); s.pos++ {
+		switch c := s.line[s.pos]; c {
+		case '\\':
+			s.pos++
+			if s.pos == len(s.line) {
+				break
+			}
+			switch c = s.line[s.pos]; c {
+			case 'n':
+				value = append(value, '\n')
+			case 't':
+				value = append(value, '\t')
+			case 'r':
+				value = append(value, '\r')
+			default:
+				value = append(value, c)
+			}
+		case '"':
+			s.pos++
+			return string(value), nil
+		default:
+			value = append(value, c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted value")
+}
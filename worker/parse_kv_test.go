@@ -0,0 +1,63 @@
+package worker_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+func TestParseLogfmt(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "logfmt")
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`level=info msg="request \"done\"" dur=12ms status=200  ok empty= uri=/q?age=47`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	good := map[string]interface{}{
+		"level":  "info",
+		"msg":    `request "done"`,
+		"dur":    "12ms",
+		"status": int64(200),
+		"ok":     true,
+		"empty":  "",
+		"uri":    "/q?age=47",
+		"age":    int64(47),
+	}
+	if !reflect.DeepEqual(m, good) {
+		t.Errorf("expected %v, actual %v", good, m)
+	}
+}
+
+func TestParseLogfmtErrors(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "logfmt")
+	w := &worker.LogParser{}
+	w.Init()
+	for _, line := range []string{`msg="unterminated`, ``, `   `} {
+		if _, err := w.ParseEvents(line); err == nil {
+			t.Errorf("expected %q not to parse", line)
+		}
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "kv")
+	viper.Set("parse.kv.pair_delimiter", ";")
+	viper.Set("parse.kv.value_delimiter", ":")
+	viper.Set("parse.keys_to_ignore", []string{"secret"})
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`host:web 1;count:3;;secret:x;note:"a;b"`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	good := map[string]interface{}{"host": "web 1", "count": int64(3), "note": "a;b"}
+	if !reflect.DeepEqual(m, good) {
+		t.Errorf("expected %v, actual %v", good, m)
+	}
+}
@@ -0,0 +1,212 @@
+package worker
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configParseSyslogTimezone = "parse.syslog.timezone"
+
+// rfc3164 matches BSD syslog lines, with or without a priority (as they are
+// written to files by most syslog daemons), and with either the traditional
+// year-less timestamp or an RFC 3339 one.
+var rfc3164 = regexp.MustCompile(`(?s)^(?:<(\d{1,3})>)?` +
+	`([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}|\d{4}-\d{2}-\d{2}T\S+)\s+` +
+	`(\S+)\s+` +
+	`(?:([^\s\[:]+)(?:\[([^\]]*)\])?: ?)?` +
+	`(.*)$`)
+
+// rfc5424Header matches the fields before the structured data of an RFC 5424 line
+var rfc5424Header = regexp.MustCompile(`^<(\d{1,3})>(\d{1,2}) (\S+) (\S+) (\S+) (\S+) (\S+) `)
+
+const rfc3164TimeFormat = "Jan _2 15:04:05"
+
+// ConfiguredSyslogTimezone is the time zone of syslog timestamps which do
+// not name one
+func ConfiguredSyslogTimezone() *time.Location {
+	name := viper.GetString(configParseSyslogTimezone)
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logs.Warn("Unknown syslog time zone %s; using local time", name)
+		return time.Local
+	}
+	return loc
+}
+
+// ParseSyslog parses an RFC 5424 line if it is one, and an RFC 3164 line otherwise
+func (w *LogParser) ParseSyslog(line string) (map[string]interface{}, error) {
+	if rfc5424Header.MatchString(line) {
+		return w.ParseRFC5424(line)
+	}
+	return w.ParseRFC3164(line)
+}
+
+// addPriority adds the priority, facility and severity for the PRI part of a line
+func (w *LogParser) addPriority(pri string, v map[string]interface{}) {
+	priority, err := strconv.Atoi(pri)
+	if err != nil {
+		return
+	}
+	w.addSyslogField("priority", int64(priority), v)
+	w.addSyslogField("facility", int64(priority/8), v)
+	w.addSyslogField("severity", int64(priority%8), v)
+}
+
+func (w *LogParser) addSyslogField(key string, value interface{}, v map[string]interface{}) {
+	if !w.shouldIgnore(key) {
+		v[key] = value
+	}
+}
+
+// ParseRFC3164 parses a BSD syslog line, like
+// `<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed`. Timestamps have
+// no year, so the year is taken to be the one which puts the time nearest
+// before now (allowing a day for clocks which differ).
+func (w *LogParser) ParseRFC3164(line string) (map[string]interface{}, error) {
+	match := rfc3164.FindStringSubmatch(line)
+	if match == nil {
+		logs.Debug("Line %s is not an RFC 3164 syslog line.", line)
+		return nil, fmt.Errorf("Line %s is not an RFC 3164 syslog line.", line)
+	}
+	v := make(map[string]interface{})
+	if match[1] != "" {
+		w.addPriority(match[1], v)
+	}
+	timestamp, err := w.parseRFC3164Time(match[2], time.Now())
+	if err != nil {
+		logs.Debug("Line %s has a bad timestamp: %v", line, err)
+		return nil, fmt.Errorf("Line %s has a bad timestamp: %v", line, err)
+	}
+	w.addSyslogField("timestamp", timestamp, v)
+	w.addSyslogField("hostname", match[3], v)
+	if match[4] != "" {
+		w.addSyslogField("app_name", match[4], v)
+	}
+	if match[5] != "" {
+		w.addSyslogField("procid", w.ParseStringForValue(match[5]), v)
+	}
+	w.addSyslogField("message", match[6], v)
+	return v, nil
+}
+
+func (w *LogParser) parseRFC3164Time(ts string, now time.Time) (time.Time, error) {
+	if strings.Contains(ts, "T") {
+		return time.Parse(time.RFC3339Nano, ts)
+	}
+	t, err := time.ParseInLocation(rfc3164TimeFormat, ts, w.syslogLocation)
+	if err != nil {
+		return t, err
+	}
+	t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	if t.After(now.AddDate(0, 0, 1)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, nil
+}
+
+// ParseRFC5424 parses an RFC 5424 syslog line, like
+// `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47
+// [exampleSDID@32473 iut="3" eventSource="Application"] An application event`.
+// Each structured data element becomes a map under structured_data, keyed by
+// its SD-ID, holding its parameters.
+func (w *LogParser) ParseRFC5424(line string) (map[string]interface{}, error) {
+	header := rfc5424Header.FindStringSubmatch(line)
+	if header == nil {
+		logs.Debug("Line %s is not an RFC 5424 syslog line.", line)
+		return nil, fmt.Errorf("Line %s is not an RFC 5424 syslog line.", line)
+	}
+	v := make(map[string]interface{})
+	w.addPriority(header[1], v)
+	w.addSyslogField("version", w.ParseStringForValue(header[2]), v)
+	if header[3] != "-" {
+		timestamp, err := time.Parse(time.RFC3339Nano, header[3])
+		if err != nil {
+			logs.Debug("Line %s has a bad timestamp: %v", line, err)
+			return nil, fmt.Errorf("Line %s has a bad timestamp: %v", line, err)
+		}
+		w.addSyslogField("timestamp", timestamp, v)
+	}
+	for i, key := range []string{"hostname", "app_name", "procid", "msgid"} {
+		if value := header[4+i]; value != "-" {
+			if key == "procid" {
+				w.addSyslogField(key, w.ParseStringForValue(value), v)
+			} else {
+				w.addSyslogField(key, value, v)
+			}
+		}
+	}
+	rest := line[len(header[0]):]
+	sd, rest, err := w.parseStructuredData(rest)
+	if err != nil {
+		logs.Debug("Line %s has bad structured data: %v", line, err)
+		return nil, fmt.Errorf("Line %s has bad structured data: %v", line, err)
+	}
+	if len(sd) > 0 {
+		w.addSyslogField("structured_data", sd, v)
+	}
+	if rest = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff"); rest != "" {
+		w.addSyslogField("message", rest, v)
+	}
+	return v, nil
+}
+
+// parseStructuredData parses the STRUCTURED-DATA part at the start of s,
+// returning the elements and the remainder of s
+func (w *LogParser) parseStructuredData(s string) (sd map[string]interface{}, rest string, err error) {
+	sd = make(map[string]interface{})
+	if strings.HasPrefix(s, "-") {
+		return sd, s[1:], nil
+	}
+	for strings.HasPrefix(s, "[") {
+		end := strings.IndexAny(s, " ]")
+		if end < 0 {
+			return nil, s, fmt.Errorf("unterminated element")
+		}
+		params := make(map[string]interface{})
+		sd[s[1:end]] = params
+		s = s[end:]
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+			eq := strings.Index(s, `="`)
+			if eq < 0 {
+				return nil, s, fmt.Errorf("bad parameter")
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var value []byte
+			for {
+				if s == "" {
+					return nil, s, fmt.Errorf("unterminated parameter value")
+				}
+				c := s[0]
+				s = s[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && s != "" && (s[0] == '"' || s[0] == '\\' || s[0] == ']') {
+					c = s[0]
+					s = s[1:]
+				}
+				value = append(value, c)
+			}
+			params[name] = w.ParseStringForValue(string(value))
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, s, fmt.Errorf("unterminated element")
+		}
+		s = s[1:]
+	}
+	if len(sd) == 0 {
+		return nil, s, fmt.Errorf("missing structured data")
+	}
+	return sd, s, nil
+}
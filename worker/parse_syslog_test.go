@@ -0,0 +1,115 @@
+package worker_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+func TestParseRFC5424(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "syslog")
+	w := &worker.LogParser{}
+	w.Init()
+	line := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high \"x\""] An application event`
+	m, err := w.ParseEvents(line)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	good := map[string]interface{}{
+		"priority":  int64(165),
+		"facility":  int64(20),
+		"severity":  int64(5),
+		"version":   int64(1),
+		"timestamp": time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+		"hostname":  "mymachine.example.com",
+		"app_name":  "evntslog",
+		"msgid":     "ID47",
+		"structured_data": map[string]interface{}{
+			"exampleSDID@32473":     map[string]interface{}{"iut": int64(3), "eventSource": "Application", "eventID": int64(1011)},
+			"examplePriority@32473": map[string]interface{}{"class": `high "x"`},
+		},
+		"message": "An application event",
+	}
+	for key, kv := range good {
+		if !reflect.DeepEqual(m[key], kv) {
+			if ti, ok := kv.(time.Time); ok && ti.Equal(m[key].(time.Time)) {
+				continue
+			}
+			t.Errorf("Testing for %v; expected: %v, actual: %v", key, kv, m[key])
+		}
+	}
+	if _, found := m["procid"]; found {
+		t.Errorf("expected nil procid to be left out")
+	}
+}
+
+func TestParseRFC5424NoStructuredData(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "rfc5424")
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su 77 - - 'su root' failed`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	if m["procid"] != int64(77) || m["message"] != "'su root' failed" || m["structured_data"] != nil {
+		t.Errorf("unexpected event %v", m)
+	}
+	if _, err := w.ParseEvents(`<34>1 2003-10-11T22:14:15.003Z host su 77 - [bad`); err == nil {
+		t.Errorf("expected bad structured data not to parse")
+	}
+}
+
+func TestParseRFC3164(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "rfc3164")
+	viper.Set("parse.syslog.timezone", "UTC")
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`<34>Oct  1 22:14:15 mymachine su[230]: 'su root' failed for lonvick`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	now := time.Now()
+	expected := time.Date(now.Year(), 10, 1, 22, 14, 15, 0, time.UTC)
+	if expected.After(now.AddDate(0, 0, 1)) {
+		expected = expected.AddDate(-1, 0, 0)
+	}
+	good := map[string]interface{}{
+		"priority":  int64(34),
+		"facility":  int64(4),
+		"severity":  int64(2),
+		"timestamp": expected,
+		"hostname":  "mymachine",
+		"app_name":  "su",
+		"procid":    int64(230),
+		"message":   "'su root' failed for lonvick",
+	}
+	if !reflect.DeepEqual(m, good) {
+		t.Errorf("expected %v, actual %v", good, m)
+	}
+}
+
+func TestParseRFC3164WithoutPriority(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.format", "syslog")
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents(`2016-04-01T11:00:00.123+00:00 web1 CRON: job started`)
+	if err != nil {
+		t.Fatalf("Couldn't parse example line: %v", err)
+	}
+	if m["hostname"] != "web1" || m["app_name"] != "CRON" || m["message"] != "job started" {
+		t.Errorf("unexpected event %v", m)
+	}
+	if _, found := m["priority"]; found {
+		t.Errorf("expected no priority, got %v", m["priority"])
+	}
+	if _, err := w.ParseEvents(`not a syslog line`); err == nil {
+		t.Errorf("expected non-syslog line not to parse")
+	}
+}
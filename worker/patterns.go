@@ -0,0 +1,110 @@
+package worker
+
+/*
+	patterns.go allows several patterns to be tried in order, for logs which
+	hold several shapes of line. The name of the pattern which matched is
+	recorded in the event, so that sinks can tell the lines apart.
+
+	parse.patterns is either a list of patterns, or a list of tables each
+	with a name and either a pattern or a preset:
+
+		[[parse.patterns]]
+		name = "access"
+		preset = "nginx_combined"
+
+		[[parse.patterns]]
+		name = "error"
+		pattern = '%{TIMESTAMP_ISO8601:created} \[%{LOGLEVEL:level}\] %{GREEDYDATA:message}'
+*/
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configParsePatterns = "parse.patterns"
+const configParsePatternKey = "parse.pattern_key"
+
+// DefaultPatternKey is the default name of the key holding the name of the matching pattern
+const DefaultPatternKey = "pattern"
+
+// NamedPattern is one of the patterns of parse.patterns
+type NamedPattern struct {
+	Name    string `mapstructure:"name"`
+	Pattern string `mapstructure:"pattern"`
+	Preset  string `mapstructure:"preset"`
+}
+
+// namedRegex is a compiled NamedPattern
+type namedRegex struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+// ConfiguredPatterns returns the patterns of parse.patterns, naming any
+// without names after their preset or their place in the list
+func ConfiguredPatterns() (patterns []NamedPattern) {
+	switch list := viper.Get(configParsePatterns).(type) {
+	case nil:
+		return nil
+	case []string:
+		for _, pattern := range list {
+			patterns = append(patterns, NamedPattern{Pattern: pattern})
+		}
+	default:
+		if values, ok := list.([]interface{}); ok && len(values) > 0 {
+			if _, isString := values[0].(string); isString {
+				for _, pattern := range values {
+					patterns = append(patterns, NamedPattern{Pattern: fmt.Sprint(pattern)})
+				}
+				break
+			}
+		}
+		if err := viper.UnmarshalKey(configParsePatterns, &patterns); err != nil {
+			logs.Warn("Could not read %s: %v", configParsePatterns, err)
+			return nil
+		}
+	}
+	for i := range patterns {
+		if patterns[i].Name == "" {
+			patterns[i].Name = patterns[i].Preset
+		}
+		if patterns[i].Name == "" {
+			patterns[i].Name = fmt.Sprintf("pattern_%d", i+1)
+		}
+	}
+	return
+}
+
+// ConfigurePatterns compiles the patterns of parse.patterns. Patterns which
+// do not compile are left out.
+func (w *LogParser) ConfigurePatterns() {
+	w.patterns = nil
+	w.patternKey = DefaultPatternKey
+	if viper.IsSet(configParsePatternKey) {
+		w.patternKey = viper.GetString(configParsePatternKey)
+	}
+	for _, named := range ConfiguredPatterns() {
+		pattern := named.Pattern
+		if named.Preset != "" {
+			preset, found := Presets[named.Preset]
+			if !found {
+				logs.Warn("Unknown preset %s in pattern %s", named.Preset, named.Name)
+				continue
+			}
+			pattern = preset.Pattern
+			w.TimePatterns = append(w.TimePatterns, preset.TimePatterns...)
+		}
+		regex, err := w.compilePattern(pattern)
+		if err != nil {
+			logs.Warn("Could not compile pattern %s. Error: %v", named.Name, err)
+			continue
+		}
+		w.patterns = append(w.patterns, namedRegex{name: named.Name, regex: regex})
+	}
+	if len(w.patterns) > 0 && (viper.GetString(configParsePattern) != "" || viper.GetString(configParsePreset) != "") {
+		logs.Warn("%s is set; ignoring %s and %s", configParsePatterns, configParsePattern, configParsePreset)
+	}
+}
@@ -0,0 +1,69 @@
+package worker_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+var patternsConfig = []byte(`
+[parse]
+pattern_key = "kind"
+
+[[parse.patterns]]
+name = "access"
+preset = "apache_common"
+
+[[parse.patterns]]
+name = "error"
+pattern = '^%{TIMESTAMP_ISO8601:created} \[%{LOGLEVEL:level}\] %{GREEDYDATA:message}'
+
+[[parse.patterns]]
+pattern = '^(?P<banner>Starting .*)'
+`)
+
+func TestParsePatterns(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.SetConfigType("toml")
+	viper.ReadConfig(bytes.NewBuffer(patternsConfig))
+	w := &worker.LogParser{}
+	w.Init()
+	var testCases = []struct {
+		line  string
+		kind  string
+		key   string
+		value interface{}
+	}{
+		{`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`, "access", "status", int64(200)},
+		{`2016-04-01T11:00:00Z [error] upstream timed out`, "error", "level", "error"},
+		{`Starting server version 1.2`, "pattern_3", "banner", "Starting server version 1.2"},
+	}
+	for i, tt := range testCases {
+		m, err := w.ParseEvents(tt.line)
+		if err != nil {
+			t.Errorf("In test %d, expected %s to match, got %v", i+1, tt.line, err)
+			continue
+		}
+		if m["kind"] != tt.kind || m[tt.key] != tt.value {
+			t.Errorf("In test %d, expected kind %v and %v=%v, got %v", i+1, tt.kind, tt.key, tt.value, m)
+		}
+	}
+	if _, err := w.ParseEvents(`something else entirely`); err == nil {
+		t.Errorf("expected a line matching no pattern to fail")
+	}
+}
+
+func TestParsePatternsList(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("parse.patterns", []string{`^(?P<number>\d+)$`, `^(?P<word>\w+)$`})
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents("hello")
+	if err != nil || m["word"] != "hello" || m["pattern"] != "pattern_2" {
+		t.Errorf("expected the second pattern to match, got %v, %v", m, err)
+	}
+}
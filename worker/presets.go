@@ -0,0 +1,59 @@
+package worker
+
+/*
+	presets.go holds named patterns for common log formats, which may be used
+	with parse.preset instead of writing parse.pattern by hand.
+
+	The presets name the request URI "uri", so that its query parameters are
+	added to events, and use "created", "status", "bytes", "referer" and
+	"user_agent" for the usual fields.
+*/
+
+const configParsePreset = "parse.preset"
+
+// Preset is a named pattern, with any time formats needed for its dates
+type Preset struct {
+	Pattern      string
+	TimePatterns []string
+}
+
+// the quoted request line of web server logs
+const requestPattern = `"(?:(?P<method>[A-Z]+) (?P<uri>\S+)(?: (?P<protocol>[^"]*))?|[^"]*)"`
+
+// the Common Log Format, used by Apache and nginx
+const commonPattern = `(?P<client>\S+) (?P<ident>\S+) (?P<user>\S+) \[(?P<created>[^\]]+)\] ` +
+	requestPattern + ` (?P<status>\d{3}) (?P<bytes>\d+|-)`
+
+// the Combined Log Format, which adds the referer and user agent
+const combinedPattern = commonPattern + ` "(?P<referer>[^"]*)" "(?P<user_agent>[^"]*)"`
+
+// Presets are the named patterns known to parse.preset
+var Presets = map[string]Preset{
+	"apache_common":   {Pattern: commonPattern},
+	"apache_combined": {Pattern: combinedPattern},
+	"nginx_combined":  {Pattern: combinedPattern},
+	// HAProxy's default "option httplog" format, with or without a syslog header
+	"haproxy_http": {
+		Pattern: `(?P<client>[\da-fA-F.:]+):(?P<client_port>\d+) \[(?P<created>[^\]]+)\] ` +
+			`(?P<frontend>\S+) (?P<backend>[^/\s]+)/(?P<server>\S+) ` +
+			`(?P<time_request>-?\d+)/(?P<time_queue>-?\d+)/(?P<time_connect>-?\d+)/(?P<time_response>-?\d+)/\+?(?P<time_total>\d+) ` +
+			`(?P<status>-?\d+) \+?(?P<bytes>\d+) (?P<request_cookie>\S+) (?P<response_cookie>\S+) (?P<termination_state>\S+) ` +
+			`(?P<actconn>\d+)/(?P<feconn>\d+)/(?P<beconn>\d+)/(?P<srvconn>\d+)/\+?(?P<retries>\d+) (?P<srv_queue>\d+)/(?P<backend_queue>\d+) ` +
+			`(?:\{(?P<request_headers>[^}]*)\} )?(?:\{(?P<response_headers>[^}]*)\} )?` + requestPattern,
+		TimePatterns: []string{"02/Jan/2006:15:04:05.000"},
+	},
+	// AWS Classic Load Balancer access logs
+	"elb": {
+		Pattern: `^(?P<created>\S+) (?P<elb>\S+) (?P<client>[^\s:]+):(?P<client_port>\d+) (?P<backend>[^\s:]+):?(?P<backend_port>\d*) ` +
+			`(?P<request_processing_time>\S+) (?P<backend_processing_time>\S+) (?P<response_processing_time>\S+) ` +
+			`(?P<status>\d{3}|-) (?P<backend_status>\d{3}|-) (?P<received_bytes>\d+) (?P<bytes>\d+) ` +
+			requestPattern + ` "(?P<user_agent>[^"]*)" (?P<ssl_cipher>\S+) (?P<ssl_protocol>\S+)`,
+	},
+	// AWS Application Load Balancer access logs
+	"alb": {
+		Pattern: `^(?P<type>\S+) (?P<created>\S+) (?P<elb>\S+) (?P<client>[^\s:]+):(?P<client_port>\d+) (?P<target>[^\s:]+):?(?P<target_port>\d*) ` +
+			`(?P<request_processing_time>\S+) (?P<target_processing_time>\S+) (?P<response_processing_time>\S+) ` +
+			`(?P<status>\d{3}|-) (?P<target_status>\d{3}|-) (?P<received_bytes>\d+) (?P<bytes>\d+) ` +
+			requestPattern + ` "(?P<user_agent>[^"]*)" (?P<ssl_cipher>\S+) (?P<ssl_protocol>\S+) (?P<target_group_arn>\S+) "(?P<trace_id>[^"]*)"`,
+	},
+}
@@ -0,0 +1,85 @@
+package worker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willf/translog/worker"
+)
+
+var presetTestCases = []struct {
+	preset  string
+	line    string
+	created time.Time
+	fields  map[string]interface{}
+}{
+	{
+		"nginx_combined",
+		`93.180.71.3 - - [17/May/2015:08:05:32 +0000] "GET /downloads/product_1?version=2 HTTP/1.1" 304 0 "-" "Debian APT-HTTP/1.3 (0.8.16~exp12ubuntu10.21)"`,
+		time.Date(2015, 5, 17, 8, 5, 32, 0, time.UTC),
+		map[string]interface{}{"client": "93.180.71.3", "method": "GET", "uri": "/downloads/product_1?version=2",
+			"version": int64(2), "status": int64(304), "bytes": int64(0), "referer": "-", "user_agent": "Debian APT-HTTP/1.3 (0.8.16~exp12ubuntu10.21)"},
+	},
+	{
+		"apache_common",
+		`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+		time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC),
+		map[string]interface{}{"user": "frank", "uri": "/apache_pb.gif", "protocol": "HTTP/1.0", "status": int64(200), "bytes": int64(2326)},
+	},
+	{
+		"haproxy_http",
+		`Feb  6 12:14:14 localhost haproxy[14389]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html?q=x HTTP/1.1"`,
+		time.Date(2009, 2, 6, 12, 14, 14, 655000000, time.UTC),
+		map[string]interface{}{"client": "10.0.1.2", "backend": "static", "server": "srv1", "time_total": int64(109),
+			"status": int64(200), "bytes": int64(2750), "request_headers": "1wt.eu", "uri": "/index.html?q=x", "q": "x"},
+	},
+	{
+		"elb",
+		`2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.000073 0.001048 0.000057 200 200 0 29 "GET http://www.example.com:80/?page=3 HTTP/1.1" "curl/7.38.0" - -`,
+		time.Date(2015, 5, 13, 23, 39, 43, 945958000, time.UTC),
+		map[string]interface{}{"elb": "my-loadbalancer", "client": "192.168.131.39", "backend": "10.0.0.1", "status": int64(200),
+			"bytes": int64(29), "uri": "http://www.example.com:80/?page=3", "page": int64(3), "user_agent": "curl/7.38.0"},
+	},
+	{
+		"alb",
+		`http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354"`,
+		time.Date(2018, 7, 2, 22, 23, 0, 186641000, time.UTC),
+		map[string]interface{}{"type": "http", "target": "10.0.0.1", "status": int64(200), "bytes": int64(366),
+			"trace_id": "Root=1-58337262-36d228ad5d99923122bbe354"},
+	},
+}
+
+func TestPresets(t *testing.T) {
+	for i, tt := range presetTestCases {
+		viper.Reset()
+		viper.Set("parse.preset", tt.preset)
+		w := &worker.LogParser{}
+		w.Init()
+		m, err := w.ParseEvents(tt.line)
+		if err != nil {
+			t.Errorf("In test %d, preset %s did not match: %v", i+1, tt.preset, err)
+			continue
+		}
+		for key, kv := range tt.fields {
+			if m[key] != kv {
+				t.Errorf("In test %d, preset %s, testing for %v; expected: %v, actual: %v", i+1, tt.preset, key, kv, m[key])
+			}
+		}
+		if created, ok := m["created"].(time.Time); !ok || !created.Equal(tt.created) {
+			t.Errorf("In test %d, preset %s, expected created %v, actual: %v", i+1, tt.preset, tt.created, m["created"])
+		}
+	}
+}
+
+func TestPatternOverridesPreset(t *testing.T) {
+	viper.Reset()
+	viper.Set("parse.preset", "nginx_combined")
+	viper.Set("parse.pattern", `(?P<word>\w+)`)
+	w := &worker.LogParser{}
+	w.Init()
+	m, err := w.ParseEvents("hello")
+	if err != nil || m["word"] != "hello" {
+		t.Errorf("expected the pattern to be used, got %v, %v", m, err)
+	}
+}
@@ -0,0 +1,167 @@
+package worker
+
+/*
+	queue.go holds the bounded queue between the LogParser and the sinks.
+
+	When the queue is full, because the sinks cannot keep up, the policy
+	decides what happens: "block" stops reading the logs until there is room,
+	"drop_oldest" makes room by dropping the event which has waited longest,
+	and "drop_newest" drops the new event. Dropped events are dead-lettered.
+*/
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configQueueCapacity = "queue.capacity"
+const configQueuePolicy = "queue.policy"
+const configQueueReportInterval = "queue.report_interval"
+
+// Queue policies, for when the queue is full
+const (
+	QueueBlock      = "block"
+	QueueDropOldest = "drop_oldest"
+	QueueDropNewest = "drop_newest"
+)
+
+// ReasonQueueFull is the dead-letter reason for events dropped from a full queue
+const ReasonQueueFull = "queue_full"
+
+// DefaultQueueCapacity is the default number of events the queue holds
+const DefaultQueueCapacity = 1000
+
+// DefaultQueueReportInterval is the default number of seconds between queue reports
+const DefaultQueueReportInterval = 60
+
+// Queue is a bounded queue of events
+type Queue struct {
+	Policy  string
+	items   chan map[string]interface{}
+	put     int64
+	dropped int64
+}
+
+// NewQueue creates a queue holding up to capacity events, and at least one,
+// so that there is an oldest event to drop
+func NewQueue(capacity int, policy string) *Queue {
+	switch policy {
+	case QueueBlock, QueueDropOldest, QueueDropNewest:
+	default:
+		logs.Warn("Unknown queue policy %s; using %s", policy, QueueBlock)
+		policy = QueueBlock
+	}
+	if capacity < 1 {
+		logs.Warn("Queue capacity %v is too small; using 1", capacity)
+		capacity = 1
+	}
+	return &Queue{Policy: policy, items: make(chan map[string]interface{}, capacity)}
+}
+
+// ConfiguredQueue creates the configured queue
+func ConfiguredQueue() *Queue {
+	capacity := DefaultQueueCapacity
+	if viper.IsSet(configQueueCapacity) {
+		capacity = viper.GetInt(configQueueCapacity)
+	}
+	policy := QueueBlock
+	if viper.IsSet(configQueuePolicy) {
+		policy = viper.GetString(configQueuePolicy)
+	}
+	return NewQueue(capacity, policy)
+}
+
+// ConfiguredQueueReportInterval is how often the queue is reported on, in seconds
+func ConfiguredQueueReportInterval() int {
+	if viper.IsSet(configQueueReportInterval) {
+		return viper.GetInt(configQueueReportInterval)
+	}
+	return DefaultQueueReportInterval
+}
+
+// Channel is the channel events are taken from
+func (q *Queue) Channel() chan map[string]interface{} {
+	return q.items
+}
+
+// Put adds an event to the queue, following the policy if it is full
+func (q *Queue) Put(obj map[string]interface{}) {
+	atomic.AddInt64(&q.put, 1)
+	switch q.Policy {
+	case QueueDropNewest:
+		select {
+		case q.items <- obj:
+		default:
+			q.drop(obj)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case q.items <- obj:
+				return
+			default:
+			}
+			select {
+			case old := <-q.items:
+				q.drop(old)
+			default:
+			}
+		}
+	default:
+		q.items <- obj
+	}
+}
+
+func (q *Queue) drop(obj map[string]interface{}) {
+	atomic.AddInt64(&q.dropped, 1)
+	DeadLetterEvent(obj, ReasonQueueFull, nil)
+	Ack(obj)
+}
+
+// Depth is the number of events waiting in the queue
+func (q *Queue) Depth() int {
+	return len(q.items)
+}
+
+// Capacity is the number of events the queue can hold
+func (q *Queue) Capacity() int {
+	return cap(q.items)
+}
+
+// Dropped is the number of events dropped because the queue was full
+func (q *Queue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// Report logs the depth of the queue, and the events put and dropped
+func (q *Queue) Report() {
+	var report struct {
+		QueueDepth    int   `json:"queue_depth"`
+		QueueCapacity int   `json:"queue_capacity"`
+		EventsPut     int64 `json:"events_put"`
+		EventsDropped int64 `json:"events_dropped"`
+	}
+	report.QueueDepth = q.Depth()
+	report.QueueCapacity = q.Capacity()
+	report.EventsPut = atomic.LoadInt64(&q.put)
+	report.EventsDropped = q.Dropped()
+	strReport, _ := json.Marshal(report)
+	logs.Info("%v", string(strReport))
+}
+
+// ReportEvery reports on the queue every interval, until quit is closed
+func (q *Queue) ReportEvery(interval time.Duration, quit chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.Report()
+		case <-quit:
+			return
+		}
+	}
+}
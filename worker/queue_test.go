@@ -0,0 +1,77 @@
+package worker_test
+
+import (
+	"testing"
+
+	"github.com/willf/translog/worker"
+)
+
+func putAll(q *worker.Queue, n int) {
+	for i := 0; i < n; i++ {
+		q.Put(map[string]interface{}{"i": i})
+	}
+}
+
+func drain(q *worker.Queue) (is []int) {
+	for q.Depth() > 0 {
+		obj := <-q.Channel()
+		is = append(is, obj["i"].(int))
+	}
+	return
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	q := worker.NewQueue(3, worker.QueueDropNewest)
+	putAll(q, 5)
+	if q.Dropped() != 2 {
+		t.Errorf("expected 2 dropped, got %v", q.Dropped())
+	}
+	is := drain(q)
+	if len(is) != 3 || is[0] != 0 || is[2] != 2 {
+		t.Errorf("expected the first 3 events to be kept, got %v", is)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	q := worker.NewQueue(3, worker.QueueDropOldest)
+	putAll(q, 5)
+	if q.Dropped() != 2 {
+		t.Errorf("expected 2 dropped, got %v", q.Dropped())
+	}
+	is := drain(q)
+	if len(is) != 3 || is[0] != 2 || is[2] != 4 {
+		t.Errorf("expected the last 3 events to be kept, got %v", is)
+	}
+}
+
+func TestQueueDropOldestWithoutCapacity(t *testing.T) {
+	q := worker.NewQueue(0, worker.QueueDropOldest)
+	putAll(q, 3)
+	if q.Capacity() != 1 || q.Dropped() != 2 {
+		t.Errorf("expected a queue of one event with 2 dropped, got capacity %v, dropped %v", q.Capacity(), q.Dropped())
+	}
+	if is := drain(q); len(is) != 1 || is[0] != 2 {
+		t.Errorf("expected the last event to be kept, got %v", is)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	q := worker.NewQueue(2, worker.QueueBlock)
+	done := make(chan bool)
+	go func() {
+		putAll(q, 3)
+		done <- true
+	}()
+	<-q.Channel()
+	<-done
+	if q.Dropped() != 0 || q.Depth() != 2 || q.Capacity() != 2 {
+		t.Errorf("expected a full queue with nothing dropped, got depth %v, dropped %v", q.Depth(), q.Dropped())
+	}
+}
+
+func TestQueueUnknownPolicy(t *testing.T) {
+	q := worker.NewQueue(1, "lose_everything")
+	if q.Policy != worker.QueueBlock {
+		t.Errorf("expected unknown policy to block, got %v", q.Policy)
+	}
+}
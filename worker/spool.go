@@ -0,0 +1,437 @@
+package worker
+
+/*
+	spool.go is an optional write-ahead spool on disk between the LogParser
+	and the sinks, so that events survive sink outages and restarts.
+
+	Events are appended, as JSON lines, to segment files in the spool
+	directory; once an event is written and synced to disk, its input
+	position may be checkpointed. Events are synced in batches: whenever no
+	more are waiting, or spoolSyncBatch have been written. A reader sends
+	the events of each segment on to the sinks in order, and a segment is
+	deleted once all of its events have been delivered. Segments left over
+	from an earlier run are replayed first, so events are delivered at
+	least once.
+
+	When the spool holds max_size bytes, writing waits for segments to be
+	delivered, which in turn holds up reading the logs.
+*/
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fizx/logs"
+	"github.com/spf13/viper"
+)
+
+const configSpoolDir = "spool.dir"
+const configSpoolSegmentSize = "spool.segment_size"
+const configSpoolMaxSize = "spool.max_size"
+
+// DefaultSpoolSegmentSize is the default size in bytes at which a new segment is started
+const DefaultSpoolSegmentSize = 16 * 1024 * 1024
+
+// DefaultSpoolMaxSize is the default most bytes the spool holds
+const DefaultSpoolMaxSize = 1024 * 1024 * 1024
+
+const spoolSuffix = ".spool"
+
+// spoolSyncBatch is the most events written before the spool is synced
+const spoolSyncBatch = 512
+
+// ReasonSpoolFailed is the dead-letter reason for events which could not
+// be written to the spool
+const ReasonSpoolFailed = "spool_failed"
+
+// spoolRecord is an event as written to the spool
+type spoolRecord struct {
+	Source string                 `json:"source,omitempty"`
+	Offset int64                  `json:"offset,omitempty"`
+	Raw    string                 `json:"raw,omitempty"`
+	Event  map[string]interface{} `json:"event"`
+}
+
+// spoolSegment is one segment file. read counts the events sent on,
+// and acked those delivered; done is set once it has been read to the end.
+type spoolSegment struct {
+	path    string
+	size    int64
+	readPos int64
+	sealed  bool
+	done    bool
+	read    int
+	acked   int
+}
+
+// Spool is a write-ahead spool of events on disk
+type Spool struct {
+	Dir         string
+	SegmentSize int64
+	MaxSize     int64
+	out         chan map[string]interface{}
+	quit        chan bool
+	lock        sync.Mutex
+	changed     *sync.Cond
+	segments    []*spoolSegment
+	current     *os.File
+	size        int64
+	nextSeq     int64
+	stopped     bool
+}
+
+// NewSpool creates a spool in dir, picking up any segments left in it
+func NewSpool(dir string, segmentSize int64, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		Dir:         dir,
+		SegmentSize: segmentSize,
+		MaxSize:     maxSize,
+		out:         make(chan map[string]interface{}),
+		quit:        make(chan bool),
+	}
+	s.changed = sync.NewCond(&s.lock)
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, &spoolSegment{path: path, size: info.Size(), sealed: true})
+		s.size += info.Size()
+		var seq int64
+		fmt.Sscanf(filepath.Base(path), "%d", &seq)
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	if len(s.segments) > 0 {
+		logs.Info("Replaying %d spool segments (%d bytes) from %s", len(s.segments), s.size, dir)
+	}
+	return s, nil
+}
+
+// ConfiguredSpool creates the configured spool, or returns nil if
+// spool.dir is not set
+func ConfiguredSpool() *Spool {
+	dir := viper.GetString(configSpoolDir)
+	if dir == "" {
+		return nil
+	}
+	segmentSize := int64(DefaultSpoolSegmentSize)
+	if viper.IsSet(configSpoolSegmentSize) {
+		segmentSize = viper.GetInt64(configSpoolSegmentSize)
+	}
+	maxSize := int64(DefaultSpoolMaxSize)
+	if viper.IsSet(configSpoolMaxSize) {
+		maxSize = viper.GetInt64(configSpoolMaxSize)
+	}
+	s, err := NewSpool(dir, segmentSize, maxSize)
+	if err != nil {
+		logs.Warn("Unable to use spool directory %s; not spooling: %v", dir, err)
+		return nil
+	}
+	return s
+}
+
+// Channel is the channel the spooled events are sent on
+func (s *Spool) Channel() chan map[string]interface{} {
+	return s.out
+}
+
+// Start starts spooling the events from in, and sending them on
+func (s *Spool) Start(in chan map[string]interface{}) {
+	go s.write(in)
+	go s.read()
+}
+
+// Stop stops the spool. A segment which has been delivered is removed.
+func (s *Spool) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	close(s.quit)
+	s.seal()
+	for _, segment := range append([]*spoolSegment{}, s.segments...) {
+		if segment.readPos >= segment.size {
+			segment.done = true
+			s.removeIfDelivered(segment)
+		}
+	}
+	s.changed.Broadcast()
+}
+
+// Size is the number of bytes in the spool
+func (s *Spool) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+func (s *Spool) write(in chan map[string]interface{}) {
+	var written []map[string]interface{}
+	for {
+		select {
+		case obj := <-in:
+			if s.append(obj) {
+				written = append(written, obj)
+			}
+		case <-s.quit:
+			// events written but not synced are not acknowledged, so
+			// they will be read again
+			return
+		}
+		if len(written) > 0 && (len(in) == 0 || len(written) >= spoolSyncBatch) {
+			s.sync()
+			for _, obj := range written {
+				Ack(obj)
+			}
+			written = written[:0]
+		}
+	}
+}
+
+// sync flushes the current segment to disk
+func (s *Spool) sync() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.current == nil {
+		return
+	}
+	if err := s.current.Sync(); err != nil {
+		logs.Warn("Unable to sync spool segment %s: %v", s.segments[len(s.segments)-1].path, err)
+	}
+}
+
+// append writes an event to the current segment. It returns true if the
+// event must be acknowledged once the segment is synced; events which
+// could not be written are dead-lettered and acknowledged at once.
+func (s *Spool) append(obj map[string]interface{}) bool {
+	record := spoolRecord{Event: EventFields(obj)}
+	if meta := Metadata(obj); meta != nil {
+		record.Source, record.Offset, record.Raw = meta.Source, meta.Offset, meta.Raw
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		logs.Info("Unable to marshal object %v", obj)
+		DeadLetterEvent(obj, ReasonMarshalFailed, err)
+		Ack(obj)
+		return false
+	}
+	line = append(line, '\n')
+	s.lock.Lock()
+	for s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxSize && !s.stopped {
+		// the current segment can only be removed once it is sealed
+		s.seal()
+		s.changed.Wait()
+	}
+	if s.stopped {
+		s.lock.Unlock()
+		return false
+	}
+	if s.current == nil || s.segments[len(s.segments)-1].size+int64(len(line)) > s.SegmentSize {
+		s.seal()
+		if err = s.newSegment(); err != nil {
+			s.lock.Unlock()
+			logs.Warn("Unable to create spool segment: %v", err)
+			DeadLetterEvent(obj, ReasonSpoolFailed, err)
+			Ack(obj)
+			return false
+		}
+	}
+	segment := s.segments[len(s.segments)-1]
+	n, err := s.current.Write(line)
+	segment.size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		// start a new segment, leaving any partial record at the end of
+		// this one to be skipped by the reader
+		s.seal()
+	}
+	s.changed.Broadcast()
+	s.lock.Unlock()
+	if err != nil {
+		logs.Warn("Unable to write to spool segment %s: %v", segment.path, err)
+		DeadLetterEvent(obj, ReasonSpoolFailed, err)
+		Ack(obj)
+		return false
+	}
+	return true
+}
+
+// newSegment starts a new segment file. The lock must be held.
+func (s *Spool) newSegment() error {
+	path := filepath.Join(s.Dir, fmt.Sprintf("%016d%s", s.nextSeq, spoolSuffix))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+	s.current = file
+	s.segments = append(s.segments, &spoolSegment{path: path})
+	return nil
+}
+
+// seal closes the current segment. The lock must be held.
+func (s *Spool) seal() {
+	if s.current == nil {
+		return
+	}
+	if err := s.current.Sync(); err != nil {
+		logs.Warn("Unable to sync spool segment %s: %v", s.segments[len(s.segments)-1].path, err)
+	}
+	s.current.Close()
+	s.current = nil
+	s.segments[len(s.segments)-1].sealed = true
+	s.changed.Broadcast()
+}
+
+// removeIfDelivered removes a segment once it has been read to the end,
+// and all of its events have been delivered. The lock must be held.
+func (s *Spool) removeIfDelivered(segment *spoolSegment) {
+	if !segment.done || segment.acked < segment.read {
+		return
+	}
+	if err := os.Remove(segment.path); err != nil {
+		logs.Warn("Unable to remove spool segment %s: %v", segment.path, err)
+	}
+	for i, other := range s.segments {
+		if other == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	s.size -= segment.size
+	s.changed.Broadcast()
+}
+
+// ack returns the function which acknowledges an event read from segment
+func (s *Spool) ack(segment *spoolSegment) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			segment.acked++
+			s.removeIfDelivered(segment)
+		})
+	}
+}
+
+// nextUnread waits for the oldest segment which has not been read to the end
+func (s *Spool) nextUnread() *spoolSegment {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for !s.stopped {
+		for _, segment := range s.segments {
+			if !segment.done {
+				return segment
+			}
+		}
+		s.changed.Wait()
+	}
+	return nil
+}
+
+func (s *Spool) read() {
+	for {
+		segment := s.nextUnread()
+		if segment == nil || !s.readSegment(segment) {
+			return
+		}
+	}
+}
+
+// finish marks a segment as read to the end
+func (s *Spool) finish(segment *spoolSegment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	segment.done = true
+	s.removeIfDelivered(segment)
+}
+
+// readSegment sends on the events of a segment, waiting for more to be
+// written until it is sealed. It returns false when the spool is stopped.
+func (s *Spool) readSegment(segment *spoolSegment) bool {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		logs.Warn("Unable to read spool segment %s: %v", segment.path, err)
+		s.finish(segment)
+		return true
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var partial []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			partial = append(partial, line...)
+			s.lock.Lock()
+			for !s.stopped && !segment.sealed && segment.readPos+int64(len(partial)) >= segment.size {
+				s.changed.Wait()
+			}
+			stopped, sealed := s.stopped, segment.sealed
+			s.lock.Unlock()
+			if stopped {
+				return false
+			}
+			if sealed && segment.readPos+int64(len(partial)) >= segment.size {
+				if len(partial) > 0 {
+					logs.Warn("Skipping incomplete record at the end of spool segment %s", segment.path)
+				}
+				s.finish(segment)
+				return true
+			}
+			continue
+		}
+		if err != nil {
+			logs.Warn("Unable to read spool segment %s: %v", segment.path, err)
+			s.finish(segment)
+			return true
+		}
+		line = append(partial, line...)
+		partial = nil
+		obj := s.decode(line, segment)
+		s.lock.Lock()
+		segment.readPos += int64(len(line))
+		if obj != nil {
+			segment.read++
+		}
+		s.lock.Unlock()
+		if obj == nil {
+			continue
+		}
+		select {
+		case s.out <- obj:
+		case <-s.quit:
+			return false
+		}
+	}
+}
+
+// decode turns a spooled line back into an event. Numbers are kept as
+// json.Number, so that they are written out as they were read.
+func (s *Spool) decode(line []byte, segment *spoolSegment) map[string]interface{} {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var record spoolRecord
+	if err := decoder.Decode(&record); err != nil || record.Event == nil {
+		logs.Warn("Skipping bad record in spool segment %s: %s", segment.path, strings.TrimSpace(string(line)))
+		return nil
+	}
+	record.Event[MetadataKey] = &EventMetadata{Source: record.Source, Offset: record.Offset, Raw: record.Raw, ack: s.ack(segment)}
+	return record.Event
+}
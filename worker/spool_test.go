@@ -0,0 +1,127 @@
+package worker_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/willf/translog/worker"
+)
+
+// spoolEvents spools n new events, and receives the first m events sent on
+func spoolEvents(t *testing.T, s *worker.Spool, n int, m int) []map[string]interface{} {
+	in := make(chan map[string]interface{})
+	s.Start(in)
+	go func() {
+		for i := 0; i < n; i++ {
+			in <- map[string]interface{}{"i": i}
+		}
+	}()
+	var events []map[string]interface{}
+	for i := 0; i < m; i++ {
+		obj := <-s.Channel()
+		if obj["i"] != json.Number(string('0'+rune(i))) {
+			t.Errorf("expected event %v, got %v", i, obj)
+		}
+		events = append(events, obj)
+	}
+	return events
+}
+
+func segmentFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spool"))
+	return files
+}
+
+func TestSpoolRemovesDeliveredSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := worker.NewSpool(dir, 30, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := spoolEvents(t, s, 5, 5)
+	if len(segmentFiles(dir)) < 2 {
+		t.Errorf("expected several segments, got %v", segmentFiles(dir))
+	}
+	for _, obj := range events {
+		worker.Ack(obj)
+	}
+	s.Stop()
+	if files := segmentFiles(dir); len(files) != 0 || s.Size() != 0 {
+		t.Errorf("expected delivered segments to be removed, got %v (%d bytes)", files, s.Size())
+	}
+}
+
+func TestSpoolReplaysUndeliveredEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := worker.NewSpool(dir, worker.DefaultSpoolSegmentSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := spoolEvents(t, s, 3, 3)
+	worker.Ack(events[0])
+	s.Stop()
+	if len(segmentFiles(dir)) != 1 {
+		t.Fatalf("expected the undelivered segment to be kept, got %v", segmentFiles(dir))
+	}
+
+	s, err = worker.NewSpool(dir, worker.DefaultSpoolSegmentSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = spoolEvents(t, s, 0, 3)
+	for _, obj := range events {
+		worker.Ack(obj)
+	}
+	s.Stop()
+	if files := segmentFiles(dir); len(files) != 0 {
+		t.Errorf("expected replayed segment to be removed, got %v", files)
+	}
+}
+
+func TestSpoolAcksOnceWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := worker.NewSpool(dir, worker.DefaultSpoolSegmentSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	in := make(chan map[string]interface{}, 10)
+	var acked int32
+	for i := 0; i < 5; i++ {
+		obj := map[string]interface{}{"i": i}
+		worker.SetAck(obj, func() { atomic.AddInt32(&acked, 1) })
+		in <- obj
+	}
+	s.Start(in)
+	for start := time.Now(); atomic.LoadInt32(&acked) < 5; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("expected the spooled events to be acknowledged, got %v", atomic.LoadInt32(&acked))
+		}
+	}
+	files := segmentFiles(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected one segment, got %v", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if lines := strings.Count(string(data), "\n"); lines != 5 {
+		t.Errorf("expected the acknowledged events to be in the segment, got %d", lines)
+	}
+}
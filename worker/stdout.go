@@ -1,7 +1,6 @@
 package worker
 
 import (
-	"encoding/json"
 	"fmt"
 	"time"
 
@@ -38,12 +37,15 @@ func (w *StdOutWorker) Work() {
 		select {
 		case obj := <-w.WorkChannel:
 			logs.Debug("Worker received: %v", obj)
-			line, err := json.Marshal(obj)
+			line, err := MarshalEvent(obj)
 			if err != nil {
 				logs.Info("Unable to marshal object %v", obj)
+				DeadLetterEvent(obj, ReasonMarshalFailed, err)
+				Ack(obj)
 				break
 			}
 			fmt.Println(string(line))
+			Ack(obj)
 
 		case <-w.QuitChannel:
 			logs.Info("Worker received quit")